@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"pr/config"
+	"pr/proxy"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs the subcommand given as the first argument, if any, and reports its exit code
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "validate":
+		return runValidate(args[1:], os.Stdout, os.Stderr), true
+	case "check":
+		return runCheck(args[1:], os.Stdout, os.Stderr), true
+	}
+	return 0, false
+}
+
+// commandFlags creates the flags of a subcommand with the --config flag shared by all of them
+func commandFlags(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", os.Getenv("PROXY_CONFIG"), "YAML or JSON configuration file. The environment variables are used if not set")
+	return flags, configPath
+}
+
+// runValidate parses and validates the configuration without starting the listeners
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := commandFlags("validate", stderr)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if _, err := loadConfig(*configPath); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return 0
+}
+
+// runCheck validates the configuration and checks that every backend is reachable over HTTP and WebSocket
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags, configPath := commandFlags("check", stderr)
+	httpPath := flags.String("http-path", "", "Path requested on every backend. The health check path or / if not set")
+	wsPath := flags.String("ws-path", "/websocket", "Path of the WebSocket handshake on every backend. The handshake is skipped if empty")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of every probe")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+	checkCfg := proxy.CheckConfig{
+		HTTPPath:      *httpPath,
+		WebSocketPath: *wsPath,
+		Timeout:       *timeout,
+		SkipCertCheck: cfg.SkipCertCheck,
+	}
+	if checkCfg.HTTPPath == "" {
+		checkCfg.HTTPPath = cfg.HealthCheck.Path
+	}
+
+	type row struct {
+		pool   string
+		result proxy.CheckResult
+	}
+	var rows []*row
+	var wg sync.WaitGroup
+	for _, name := range poolNames(cfg) {
+		pool := cfg.Pools[name]
+		poolCheckCfg := checkCfg
+		if pool.TLS != nil {
+			// The configuration is validated, so the files can be loaded
+			poolCheckCfg.TLSConfig, _ = proxy.NewBackendTLSConfig(pool.TLS.ProxyConfig())
+		}
+		for _, b := range append(pool.HTTPBackends, pool.HTTPSBackends...) {
+			// The configuration is validated, so the URLs are valid
+			u, _ := url.Parse(b.URL)
+			r := &row{pool: name}
+			rows = append(rows, r)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.result = proxy.CheckBackend(context.Background(), u, poolCheckCfg)
+			}()
+		}
+	}
+	wg.Wait()
+
+	failed := 0
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tBACKEND\tHTTP\tWEBSOCKET\tTLS\tSTATUS")
+	for _, r := range rows {
+		status := "ok"
+		if !r.result.OK() {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.pool, r.result.URL, httpColumn(r.result), webSocketColumn(r.result), tlsColumn(r.result), status)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(stderr, "%d of %d backends failed the check\n", failed, len(rows))
+		return 1
+	}
+	return 0
+}
+
+func poolNames(cfg *config.Config) []string {
+	names := make([]string, 0, len(cfg.Pools))
+	for name := range cfg.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func httpColumn(r proxy.CheckResult) string {
+	if r.HTTPErr != nil {
+		return fmt.Sprintf("error: %v", r.HTTPErr)
+	}
+	return fmt.Sprintf("%d in %v", r.HTTPStatus, r.HTTPLatency.Round(time.Millisecond))
+}
+
+func webSocketColumn(r proxy.CheckResult) string {
+	if r.WebSocketErr != nil {
+		return fmt.Sprintf("error: %v", r.WebSocketErr)
+	}
+	if r.WebSocketLatency == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("ok in %v", r.WebSocketLatency.Round(time.Millisecond))
+}
+
+func tlsColumn(r proxy.CheckResult) string {
+	if r.Certificate == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s, expires %s", r.Certificate.Subject.CommonName, r.Certificate.NotAfter.Format(time.DateOnly))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestCommand runs the command with a configuration file of the given content
+func runTestCommand(t *testing.T, run func(args []string, stdout, stderr io.Writer) int, content string, args ...string) (int, string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, content)
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"--config", path}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunValidate(t *testing.T) {
+	code, stdout, _ := runTestCommand(t, runValidate, testConfig("http://localhost:8081"))
+	if code != 0 || !strings.Contains(stdout, "Configuration is valid") {
+		t.Errorf("Expected a valid configuration, got %d %q", code, stdout)
+	}
+
+	code, _, stderr := runTestCommand(t, runValidate, testConfig("localhost:8081")+"load_balancer: random\n")
+	if code != 1 || !strings.Contains(stderr, "pools.default.http_backends[0].url") || !strings.Contains(stderr, "load_balancer") {
+		t.Errorf("Expected every problem of the configuration to be reported, got %d %q", code, stderr)
+	}
+
+	var stdout2, stderr2 bytes.Buffer
+	if code := runValidate([]string{"--unknown"}, &stdout2, &stderr2); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown flag, got %d", code)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	backend := newNamedServer(t, "backend")
+	unreachable := httptest.NewServer(nil)
+	unreachable.Close()
+
+	code, stdout, _ := runTestCommand(t, runCheck, testConfig(backend.URL), "--ws-path", "")
+	if code != 0 || !strings.Contains(stdout, backend.URL) || !strings.Contains(stdout, "200 in") || strings.Contains(stdout, "FAILED") {
+		t.Errorf("Expected the backend to pass the check, got %d:\n%s", code, stdout)
+	}
+
+	// The backend doesn't accept WebSocket connections
+	code, stdout, stderr := runTestCommand(t, runCheck, testConfig(backend.URL))
+	if code != 1 || !strings.Contains(stdout, "FAILED") || !strings.Contains(stderr, "1 of 1 backends failed") {
+		t.Errorf("Expected the WebSocket handshake to fail, got %d:\n%s%s", code, stdout, stderr)
+	}
+
+	code, stdout, _ = runTestCommand(t, runCheck, testConfig(unreachable.URL), "--ws-path", "", "--timeout", "1s")
+	if code != 1 || !strings.Contains(stdout, "error:") || !strings.Contains(stdout, "FAILED") {
+		t.Errorf("Expected the unreachable backend to fail the check, got %d:\n%s", code, stdout)
+	}
+
+	code, _, stderr = runTestCommand(t, runCheck, testConfig("localhost:8081"))
+	if code != 1 || !strings.Contains(stderr, "Invalid configuration") {
+		t.Errorf("Expected the invalid configuration to be reported, got %d %q", code, stderr)
+	}
+}
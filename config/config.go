@@ -0,0 +1,405 @@
+// Package config describes the proxy configuration, loaded either from a YAML/JSON file or from environment variables
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"pr/proxy"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPoolName is the pool serving the requests not matched by any route
+const DefaultPoolName = "default"
+
+// Config is the whole configuration of the proxy
+type Config struct {
+	Listeners []Listener `yaml:"listeners"`
+	Admin     Admin      `yaml:"admin"`
+	Auth      Auth       `yaml:"auth"`
+	Timeouts  Timeouts   `yaml:"timeouts"`
+	// SkipCertCheck disables verification of the backend certificates of the pools without TLS settings
+	SkipCertCheck bool `yaml:"skip_cert_check"`
+	// LoadBalancer is the default strategy of the pools, see proxy.NewBalancer
+	LoadBalancer string `yaml:"load_balancer"`
+	// HashKey is the default hash key of the consistent_hash strategy, see proxy.ParseHashKey
+	HashKey string           `yaml:"hash_key"`
+	Pools   map[string]*Pool `yaml:"pools"`
+	// VirtualHosts by name. Routes refer to them by name
+	VirtualHosts map[string]*VirtualHost `yaml:"virtual_hosts"`
+	// DefaultVirtualHost serves the requests to unknown hosts. The routes without virtual host are used if empty,
+	// the requests are rejected if "none"
+	DefaultVirtualHost string `yaml:"default_virtual_host"`
+	// UnknownHostStatus is the status of the requests to unknown hosts when there is no default virtual host
+	UnknownHostStatus int     `yaml:"unknown_host_status"`
+	Routes            []Route `yaml:"routes"`
+
+	HealthCheck      HealthCheck      `yaml:"health_check"`
+	OutlierDetection OutlierDetection `yaml:"outlier_detection"`
+	StickySession    StickySession    `yaml:"sticky_session"`
+	Retry            Retry            `yaml:"retry"`
+	Hedge            Hedge            `yaml:"hedge"`
+	WebSocket        WebSocket        `yaml:"websocket"`
+	Transport        Transport        `yaml:"transport"`
+	Mirror           Mirror           `yaml:"mirror"`
+}
+
+// Listener is an address the proxy accepts requests on
+type Listener struct {
+	Name string `yaml:"name"`
+	// Address is a TCP address, e.g. ":8080" or "[::1]:8080", or the path of a Unix socket, e.g. "unix:/run/proxy.sock"
+	Address string `yaml:"address"`
+	// TLS makes the listener accept HTTPS requests. Plain HTTP if nil
+	TLS *TLS `yaml:"tls"`
+	// Routes served by the listener by name. All the routes are served if empty
+	Routes []string `yaml:"routes"`
+}
+
+// Network returns the network and the address to listen on
+func (l Listener) Network() (string, string) {
+	if path, ok := strings.CutPrefix(l.Address, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", l.Address
+}
+
+// Serves reports whether the listener serves the route
+func (l Listener) Serves(route string) bool {
+	return len(l.Routes) == 0 || slices.Contains(l.Routes, route)
+}
+
+// TLS is the certificate set of an HTTPS listener
+type TLS struct {
+	// CertFile and KeyFile are the default certificate
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Certificates are selected by the server name the client asks for, falling back to the default certificate
+	Certificates []Certificate `yaml:"certificates"`
+}
+
+// Certificate is a certificate with its private key
+type Certificate struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// All returns the default certificate, if any, followed by the other certificates
+func (t *TLS) All() []Certificate {
+	var certs []Certificate
+	if t.CertFile != "" || t.KeyFile != "" {
+		certs = append(certs, Certificate{CertFile: t.CertFile, KeyFile: t.KeyFile})
+	}
+	return append(certs, t.Certificates...)
+}
+
+// Admin configures the admin server. It's disabled if the address is empty.
+// The address has the same format as the listener addresses
+type Admin struct {
+	Address string `yaml:"address"`
+}
+
+// Auth lists the bearer tokens accepted by the proxy. Requests are not authorized if there are no tokens
+type Auth struct {
+	Tokens []string `yaml:"tokens"`
+}
+
+// Timeouts of the listeners. Zero means no timeout
+type Timeouts struct {
+	// GracefulShutdown is the time given to the open connections to complete on shutdown
+	GracefulShutdown Duration `yaml:"graceful_shutdown"`
+	ReadHeader       Duration `yaml:"read_header"`
+	Read             Duration `yaml:"read"`
+	Write            Duration `yaml:"write"`
+	Idle             Duration `yaml:"idle"`
+}
+
+// Pool is a named group of backends
+type Pool struct {
+	// LoadBalancer overrides the default strategy for the pool
+	LoadBalancer string `yaml:"load_balancer"`
+	HashKey      string `yaml:"hash_key"`
+	// HTTPBackends serve the requests received on plain HTTP listeners
+	HTTPBackends []Backend `yaml:"http_backends"`
+	// HTTPSBackends serve the requests received on HTTPS listeners
+	HTTPSBackends []Backend `yaml:"https_backends"`
+	// TLS configures the connections to the HTTPS backends. The system roots verify the certificates if nil
+	TLS *BackendTLS `yaml:"tls"`
+}
+
+// BackendTLS configures the TLS connections to the backends of a pool, see proxy.BackendTLSConfig
+type BackendTLS struct {
+	CAFiles    []string `yaml:"ca_files"`
+	ServerName string   `yaml:"server_name"`
+	// Pins are the SHA-256 hashes of the accepted public keys, e.g. "sha256/AbC...="
+	Pins       []string `yaml:"pins"`
+	MinVersion string   `yaml:"min_version"`
+	// CertFile and KeyFile are the client certificate for mTLS
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// ProxyConfig returns the settings in the form expected by proxy.NewBackendTLSConfig
+func (t *BackendTLS) ProxyConfig() proxy.BackendTLSConfig {
+	return proxy.BackendTLSConfig{
+		CAFiles:    t.CAFiles,
+		ServerName: t.ServerName,
+		Pins:       t.Pins,
+		MinVersion: t.MinVersion,
+		CertFile:   t.CertFile,
+		KeyFile:    t.KeyFile,
+	}
+}
+
+// Backend is a server of a pool
+type Backend struct {
+	URL string `yaml:"url"`
+	// Weight of the backend relative to the other backends of the pool. 1 if not set
+	Weight int `yaml:"weight"`
+}
+
+// VirtualHost is a group of host names with their own routes
+type VirtualHost struct {
+	// Hosts are exact names or wildcards, e.g. "example.com" or "*.example.com"
+	Hosts []string `yaml:"hosts"`
+	// Pool serves the requests not matched by any route of the virtual host. They are rejected if empty
+	Pool string `yaml:"pool"`
+}
+
+// Route maps requests to a pool
+type Route struct {
+	Name string `yaml:"name"`
+	// Path prefix, e.g. "/api/", or regular expression prefixed with "~", e.g. "~^/users/\d+$"
+	Path string `yaml:"path"`
+	Pool string `yaml:"pool"`
+	// VirtualHost the route belongs to. The route belongs to the routes without virtual host if empty
+	VirtualHost string `yaml:"virtual_host"`
+	// Match is a predicate on the headers, cookies, query parameters or method, see proxy.ParsePredicate
+	Match    string `yaml:"match"`
+	Priority int    `yaml:"priority"`
+	// Split splits the traffic between several pools. Used instead of the pool if set
+	Split         []SplitTarget `yaml:"split"`
+	SplitKey      string        `yaml:"split_key"`
+	SplitOverride string        `yaml:"split_override"`
+	Mirror        *RouteMirror  `yaml:"mirror"`
+	Rewrite       *Rewrite      `yaml:"rewrite"`
+	Redirect      *Redirect     `yaml:"redirect"`
+}
+
+// SplitTarget is a pool receiving a share of the traffic of a route
+type SplitTarget struct {
+	Pool   string `yaml:"pool"`
+	Weight int    `yaml:"weight"`
+}
+
+// RouteMirror copies the requests of a route to a shadow pool
+type RouteMirror struct {
+	Pool string `yaml:"pool"`
+	// Percent of the requests mirrored. All of them if nil
+	Percent *float64 `yaml:"percent"`
+}
+
+// Rewrite rewrites the path of the requests of a route
+type Rewrite struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	AddPrefix   string `yaml:"add_prefix"`
+	Regex       string `yaml:"regex"`
+	Replace     string `yaml:"replace"`
+}
+
+// Redirect answers the requests of a route with a redirect
+type Redirect struct {
+	Status   int    `yaml:"status"`
+	Location string `yaml:"location"`
+}
+
+// HealthCheck configures the active health checks. They are disabled if the path is empty
+type HealthCheck struct {
+	Path               string   `yaml:"path"`
+	Interval           Duration `yaml:"interval"`
+	Timeout            Duration `yaml:"timeout"`
+	HealthyThreshold   int      `yaml:"healthy_threshold"`
+	UnhealthyThreshold int      `yaml:"unhealthy_threshold"`
+	ExpectedStatuses   []int    `yaml:"expected_statuses"`
+}
+
+// OutlierDetection configures the passive outlier detection. It's disabled if both thresholds are 0
+type OutlierDetection struct {
+	ConsecutiveFailures int      `yaml:"consecutive_failures"`
+	ErrorRatePercent    int      `yaml:"error_rate_percent"`
+	MinRequests         int      `yaml:"min_requests"`
+	Window              Duration `yaml:"window"`
+	Cooldown            Duration `yaml:"cooldown"`
+	HalfOpenRequests    int      `yaml:"half_open_requests"`
+}
+
+// StickySession configures the session affinity. It's disabled if the cookie name is empty
+type StickySession struct {
+	Cookie string `yaml:"cookie"`
+	// Secret signing the cookies. A random one is generated if empty
+	Secret string `yaml:"secret"`
+}
+
+// Retry configures the retries. They are disabled if MaxAttempts is less than 2
+type Retry struct {
+	MaxAttempts       int      `yaml:"max_attempts"`
+	Methods           []string `yaml:"methods"`
+	Statuses          []int    `yaml:"statuses"`
+	PerTryTimeout     Duration `yaml:"per_try_timeout"`
+	BudgetPercent     int      `yaml:"budget_percent"`
+	MaxBodySize       int64    `yaml:"max_body_size"`
+	IdempotencyHeader string   `yaml:"idempotency_header"`
+}
+
+// Hedge configures the hedged requests. They are disabled if the delay is 0
+type Hedge struct {
+	Delay         Duration `yaml:"delay"`
+	Percentile    int      `yaml:"percentile"`
+	BudgetPercent int      `yaml:"budget_percent"`
+}
+
+// WebSocket configures the WebSocket connections to the backends
+type WebSocket struct {
+	DialAttempts int      `yaml:"dial_attempts"`
+	DialTimeout  Duration `yaml:"dial_timeout"`
+}
+
+// Transport configures the connection pool of every backend, see proxy.TransportConfig
+type Transport struct {
+	MaxIdleConns        int      `yaml:"max_idle_conns"`
+	MaxConnsPerHost     int      `yaml:"max_conns_per_host"`
+	IdleTimeout         Duration `yaml:"idle_timeout"`
+	DialTimeout         Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout Duration `yaml:"tls_handshake_timeout"`
+}
+
+// Mirror configures the traffic mirroring of the routes with a shadow pool
+type Mirror struct {
+	MaxBodySize   int64    `yaml:"max_body_size"`
+	Timeout       Duration `yaml:"timeout"`
+	MaxConcurrent int      `yaml:"max_concurrent"`
+	// DiffFile enables the comparison of the responses. The mismatches are appended to it
+	DiffFile         string   `yaml:"diff_file"`
+	DiffHeaders      []string `yaml:"diff_headers"`
+	DiffIgnoreFields []string `yaml:"diff_ignore_fields"`
+	DiffMaxBodySize  int64    `yaml:"diff_max_body_size"`
+}
+
+// PoolBalancer returns the load balancer name and hash key of the pool, falling back to the defaults
+func (c *Config) PoolBalancer(name string) (string, string) {
+	balancer, hashKey := c.LoadBalancer, c.HashKey
+	if pool := c.Pools[name]; pool != nil {
+		if pool.LoadBalancer != "" {
+			balancer = pool.LoadBalancer
+		}
+		if pool.HashKey != "" {
+			hashKey = pool.HashKey
+		}
+	}
+	return balancer, hashKey
+}
+
+// Duration is a time.Duration written as a string, e.g. "1.5s" or "100ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the configuration used for the settings missing from the file
+func Default() *Config {
+	return &Config{
+		Listeners: []Listener{
+			{Name: "http", Address: ":8080"},
+			{Name: "https", Address: ":8443", TLS: &TLS{CertFile: "server.crt", KeyFile: "server.key"}},
+		},
+		Timeouts:          Timeouts{GracefulShutdown: Duration(20 * time.Second)},
+		UnknownHostStatus: http.StatusMisdirectedRequest,
+		HealthCheck: HealthCheck{
+			Interval:           Duration(10 * time.Second),
+			Timeout:            Duration(2 * time.Second),
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+		OutlierDetection: OutlierDetection{
+			MinRequests:      20,
+			Window:           Duration(10 * time.Second),
+			Cooldown:         Duration(30 * time.Second),
+			HalfOpenRequests: 3,
+		},
+		Retry: Retry{
+			BudgetPercent:     20,
+			MaxBodySize:       64 * 1024,
+			IdempotencyHeader: "Idempotency-Key",
+		},
+		Hedge:     Hedge{BudgetPercent: 10},
+		WebSocket: WebSocket{DialAttempts: 3, DialTimeout: Duration(10 * time.Second)},
+		Transport: Transport{
+			MaxIdleConns:        100,
+			IdleTimeout:         Duration(90 * time.Second),
+			DialTimeout:         Duration(30 * time.Second),
+			TLSHandshakeTimeout: Duration(10 * time.Second),
+		},
+		Mirror: Mirror{
+			MaxBodySize:     64 * 1024,
+			Timeout:         Duration(10 * time.Second),
+			MaxConcurrent:   100,
+			DiffMaxBodySize: 1024 * 1024,
+		},
+	}
+}
+
+// Load reads and validates the configuration file. JSON being a subset of YAML, both formats are accepted
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses and validates the configuration. Environment variables are interpolated in the values,
+// e.g. "${TOKEN}" or "${PORT:-8080}"
+func Parse(data []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("empty configuration")
+		}
+		return nil, err
+	}
+	if err := interpolate(&doc); err != nil {
+		return nil, err
+	}
+	if err := checkFields(&doc, "", typeOfConfig); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if err := doc.Decode(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+listeners:
+  - name: http
+    address: ":8080"
+auth:
+  tokens: ["${TEST_PROXY_TOKEN}"]
+timeouts:
+  graceful_shutdown: 5s
+pools:
+  default:
+    http_backends:
+      - url: http://localhost:8081
+        weight: 3
+      - url: ${TEST_PROXY_BACKEND:-http://localhost:8082}
+  api:
+    load_balancer: least_connections
+    http_backends:
+      - url: http://localhost:9081
+routes:
+  - name: api
+    path: /api/
+    pool: api
+    rewrite:
+      regex: ^/api/users/(\d+)$
+      replace: /users/$1
+  - name: profiles
+    path: /profiles/
+    pool: api
+    rewrite:
+      regex: ^/profiles/(?P<id>\d+)/(\w+)$
+      replace: /users/$${id}/${2}
+  - name: web
+    path: /
+    split:
+      - pool: default
+        weight: 95
+      - pool: api
+        weight: 5
+    mirror:
+      pool: api
+      percent: 10
+`
+
+func TestParse(t *testing.T) {
+	t.Setenv("TEST_PROXY_TOKEN", "secret")
+	cfg, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+
+	if len(cfg.Listeners) != 1 || cfg.Listeners[0].TLS != nil {
+		t.Errorf("Expected the listeners of the file to replace the default ones, got %+v", cfg.Listeners)
+	}
+	if len(cfg.Auth.Tokens) != 1 || cfg.Auth.Tokens[0] != "secret" {
+		t.Errorf("Expected the token to be read from the environment, got %v", cfg.Auth.Tokens)
+	}
+	if backends := cfg.Pools["default"].HTTPBackends; len(backends) != 2 || backends[0].Weight != 3 || backends[1].URL != "http://localhost:8082" {
+		t.Errorf("Unexpected backends %+v", backends)
+	}
+	if time.Duration(cfg.Timeouts.GracefulShutdown) != 5*time.Second {
+		t.Errorf("Expected graceful shutdown timeout of 5s, got %v", time.Duration(cfg.Timeouts.GracefulShutdown))
+	}
+	// Settings missing from the file keep their default
+	if cfg.WebSocket.DialAttempts != 3 || cfg.UnknownHostStatus != 421 || cfg.Transport.MaxIdleConns != 100 {
+		t.Errorf("Expected default settings, got %+v, %d and %+v", cfg.WebSocket, cfg.UnknownHostStatus, cfg.Transport)
+	}
+	if cfg.Routes[0].Rewrite.Replace != "/users/$1" {
+		t.Errorf("Expected capture references to be kept, got %q", cfg.Routes[0].Rewrite.Replace)
+	}
+	if cfg.Routes[1].Rewrite.Replace != "/users/${id}/${2}" {
+		t.Errorf("Expected named and numeric capture references to be kept, got %q", cfg.Routes[1].Rewrite.Replace)
+	}
+	if balancer, _ := cfg.PoolBalancer("api"); balancer != "least_connections" {
+		t.Errorf("Expected the pool balancer, got %q", balancer)
+	}
+}
+
+func TestParse_JSON(t *testing.T) {
+	cfg, err := Parse([]byte(`{"pools": {"default": {"http_backends": [{"url": "http://localhost:8081"}]}}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	if len(cfg.Pools["default"].HTTPBackends) != 1 {
+		t.Errorf("Unexpected pools %+v", cfg.Pools)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "unset variable",
+			config:   "auth:\n  tokens: [\"${TEST_PROXY_UNSET}\"]",
+			expected: []string{"line 2: environment variable TEST_PROXY_UNSET is not set"},
+		},
+		{
+			name:     "unknown field",
+			config:   "pools:\n  default:\n    http_backend:\n      - url: http://localhost:8081",
+			expected: []string{"line 3: unknown field pools.default.http_backend"},
+		},
+		{
+			name:     "invalid duration",
+			config:   "timeouts:\n  read: 5",
+			expected: []string{`line 2: invalid duration "5"`},
+		},
+		{
+			name: "invalid listeners",
+			config: `
+listeners:
+  - name: http
+    address: "8080"
+  - name: https
+    address: "[::1]:8443"
+    tls:
+      certificates:
+        - cert_file: server.crt
+    routes: [api]
+  - name: socket
+    address: "[::1]:8443"
+admin:
+  address: unix:/run/proxy-admin.sock
+`,
+			expected: []string{
+				`listeners[0].address: invalid address "8080", expected host:port or unix:path`,
+				`listeners[1].tls.certificates[0]: both cert_file and key_file are required`,
+				`listeners[1].routes[0]: unknown route "api"`,
+				`listeners[2].address: duplicate address "[::1]:8443"`,
+			},
+		},
+		{
+			name:     "invalid backend tls",
+			config:   "pools:\n  default:\n    https_backends:\n      - url: https://localhost:8444\n    tls:\n      ca_files: [missing.pem]",
+			expected: []string{"pools.default.tls: open missing.pem: no such file or directory"},
+		},
+		{
+			name: "invalid references",
+			config: `
+pools:
+  default:
+    http_backends:
+      - url: localhost:8081
+routes:
+  - name: api
+    path: api/
+    pool: apii
+  - name: api
+    path: /
+    split:
+      - pool: default
+        weight: 100
+    redirect:
+      status: 200
+      location: example.com
+`,
+			expected: []string{
+				`pools.default.http_backends[0].url: URL "localhost:8081" must be absolute with the http or https scheme`,
+				`routes[0].path: route api: prefix "api/" must start with /`,
+				`routes[0].pool: unknown pool "apii"`,
+				`routes[1].name: duplicate route "api"`,
+				`routes[1].split: at least two pools are required`,
+				`routes[1].redirect.status: unsupported redirect status 200`,
+				`routes[1].redirect.location: location "example.com" must be an absolute URL`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.config))
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected error %q, got:\n%v", expected, err)
+				}
+			}
+		})
+	}
+}
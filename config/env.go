@@ -0,0 +1,436 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"pr/proxy"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// FromEnv reads the configuration from the environment variables, loading the .env file first if it exists:
+//
+//	HTTP_SERVER_URL_<n>=http://localhost:8081;weight=3;pool=api
+//	HTTPS_SERVER_URL_<n>=https://localhost:8444
+//	ROUTE_<name>=/api/;pool=api
+//	VHOST_<name>=example.com,*.example.com;pool=web
+//	LISTENER_<name>=:8443;cert=server.crt;key=server.key;routes=api,web
+//	POOL_TLS_<pool>=ca=ca.pem;server_name=api.internal;min_version=1.2
+//	AUTH_TOKEN_<n>=secret
+//
+// along with the settings documented in the README
+func FromEnv() (*Config, error) {
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	env := &envReader{}
+	cfg := Default()
+	cfg.Pools = make(map[string]*Pool)
+	cfg.VirtualHosts = make(map[string]*VirtualHost)
+	var listeners []Listener
+	poolTLS := make(map[string]*BackendTLS)
+
+	for _, envVar := range os.Environ() {
+		key, value, ok := strings.Cut(envVar, "=")
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(key, "HTTP_SERVER_URL_") || strings.HasPrefix(key, "HTTPS_SERVER_URL_") {
+			backend, name, err := parseBackend(value)
+			if err != nil {
+				env.errs = append(env.errs, fmt.Errorf("%s: %v", key, err))
+				continue
+			}
+
+			pool := cfg.Pools[name]
+			if pool == nil {
+				pool = &Pool{}
+				cfg.Pools[name] = pool
+			}
+			if strings.HasPrefix(key, "HTTPS_") {
+				pool.HTTPSBackends = append(pool.HTTPSBackends, backend)
+			} else {
+				pool.HTTPBackends = append(pool.HTTPBackends, backend)
+			}
+		} else if name, ok := strings.CutPrefix(key, "ROUTE_"); ok {
+			route, err := parseRoute(name, value)
+			if err != nil {
+				env.errs = append(env.errs, fmt.Errorf("%s: %v", key, err))
+				continue
+			}
+
+			cfg.Routes = append(cfg.Routes, route)
+		} else if name, ok := strings.CutPrefix(key, "VHOST_"); ok {
+			vhost, err := parseVirtualHost(value)
+			if err != nil {
+				env.errs = append(env.errs, fmt.Errorf("%s: %v", key, err))
+				continue
+			}
+
+			cfg.VirtualHosts[name] = vhost
+		} else if name, ok := strings.CutPrefix(key, "LISTENER_"); ok {
+			listener, err := parseListener(name, value)
+			if err != nil {
+				env.errs = append(env.errs, fmt.Errorf("%s: %v", key, err))
+				continue
+			}
+
+			listeners = append(listeners, listener)
+		} else if name, ok := strings.CutPrefix(key, "POOL_TLS_"); ok {
+			tls, err := parseBackendTLS(value)
+			if err != nil {
+				env.errs = append(env.errs, fmt.Errorf("%s: %v", key, err))
+				continue
+			}
+
+			poolTLS[name] = tls
+		} else if strings.HasPrefix(key, "AUTH_TOKEN_") {
+			cfg.Auth.Tokens = append(cfg.Auth.Tokens, value)
+		}
+	}
+
+	// Regexp routes are matched in order, so the order must not depend on the environment
+	sort.Slice(cfg.Routes, func(i, j int) bool { return cfg.Routes[i].Name < cfg.Routes[j].Name })
+	for name, tls := range poolTLS {
+		if pool := cfg.Pools[name]; pool != nil {
+			pool.TLS = tls
+		} else {
+			env.errs = append(env.errs, fmt.Errorf("POOL_TLS_%s: unknown pool %q", name, name))
+		}
+	}
+	// The listeners replace the default ones
+	if len(listeners) > 0 {
+		sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+		cfg.Listeners = listeners
+	}
+
+	cfg.Admin.Address = os.Getenv("ADMIN_ADDR")
+	cfg.Timeouts.GracefulShutdown = env.seconds("GRACEFUL_SHUTDOWN_TIMEOUT_SEC", 20)
+	cfg.SkipCertCheck = os.Getenv("SKIP_CERT_CHECK") == "true"
+	cfg.LoadBalancer = os.Getenv("LOAD_BALANCER")
+	cfg.HashKey = os.Getenv("HASH_KEY")
+	cfg.DefaultVirtualHost = os.Getenv("DEFAULT_VHOST")
+	cfg.UnknownHostStatus = env.int("UNKNOWN_HOST_STATUS", cfg.UnknownHostStatus)
+
+	cfg.HealthCheck = HealthCheck{
+		Path:               os.Getenv("HEALTH_CHECK_PATH"),
+		Interval:           env.seconds("HEALTH_CHECK_INTERVAL_SEC", 10),
+		Timeout:            env.seconds("HEALTH_CHECK_TIMEOUT_SEC", 2),
+		HealthyThreshold:   env.int("HEALTH_CHECK_HEALTHY_THRESHOLD", 2),
+		UnhealthyThreshold: env.int("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3),
+		ExpectedStatuses:   env.ints("HEALTH_CHECK_EXPECTED_STATUSES"),
+	}
+	cfg.OutlierDetection = OutlierDetection{
+		ConsecutiveFailures: env.int("OUTLIER_CONSECUTIVE_FAILURES", 0),
+		ErrorRatePercent:    env.int("OUTLIER_ERROR_RATE_PERCENT", 0),
+		MinRequests:         env.int("OUTLIER_MIN_REQUESTS", 20),
+		Window:              env.seconds("OUTLIER_WINDOW_SEC", 10),
+		Cooldown:            env.seconds("OUTLIER_COOLDOWN_SEC", 30),
+		HalfOpenRequests:    env.int("OUTLIER_HALF_OPEN_REQUESTS", 3),
+	}
+	cfg.StickySession = StickySession{
+		Cookie: os.Getenv("STICKY_SESSION_COOKIE"),
+		Secret: os.Getenv("STICKY_SESSION_SECRET"),
+	}
+	cfg.Retry = Retry{
+		MaxAttempts:       env.int("RETRY_MAX_ATTEMPTS", 0),
+		Methods:           envList("RETRY_METHODS"),
+		Statuses:          env.ints("RETRY_STATUSES"),
+		PerTryTimeout:     Duration(env.int("RETRY_PER_TRY_TIMEOUT_MS", 0)) * Duration(time.Millisecond),
+		BudgetPercent:     env.int("RETRY_BUDGET_PERCENT", 20),
+		MaxBodySize:       int64(env.int("RETRY_MAX_BODY_BYTES", 64*1024)),
+		IdempotencyHeader: envOrDefault("RETRY_IDEMPOTENCY_HEADER", "Idempotency-Key"),
+	}
+	cfg.Hedge = Hedge{
+		Delay:         Duration(env.int("HEDGE_DELAY_MS", 0)) * Duration(time.Millisecond),
+		Percentile:    env.int("HEDGE_PERCENTILE", 0),
+		BudgetPercent: env.int("HEDGE_BUDGET_PERCENT", 10),
+	}
+	cfg.WebSocket = WebSocket{
+		DialAttempts: env.int("WS_DIAL_MAX_ATTEMPTS", 3),
+		DialTimeout:  env.seconds("WS_DIAL_TIMEOUT_SEC", 10),
+	}
+	cfg.Transport = Transport{
+		MaxIdleConns:        env.int("TRANSPORT_MAX_IDLE_CONNS", 100),
+		MaxConnsPerHost:     env.int("TRANSPORT_MAX_CONNS_PER_HOST", 0),
+		IdleTimeout:         env.seconds("TRANSPORT_IDLE_TIMEOUT_SEC", 90),
+		DialTimeout:         env.seconds("TRANSPORT_DIAL_TIMEOUT_SEC", 30),
+		TLSHandshakeTimeout: env.seconds("TRANSPORT_TLS_HANDSHAKE_TIMEOUT_SEC", 10),
+	}
+	cfg.Mirror = Mirror{
+		MaxBodySize:      int64(env.int("MIRROR_MAX_BODY_BYTES", 64*1024)),
+		Timeout:          env.seconds("MIRROR_TIMEOUT_SEC", 10),
+		MaxConcurrent:    env.int("MIRROR_MAX_CONCURRENT", 100),
+		DiffFile:         os.Getenv("MIRROR_DIFF_FILE"),
+		DiffHeaders:      envList("MIRROR_DIFF_HEADERS"),
+		DiffIgnoreFields: envList("MIRROR_DIFF_IGNORE_FIELDS"),
+		DiffMaxBodySize:  int64(env.int("MIRROR_DIFF_MAX_BODY_BYTES", 1024*1024)),
+	}
+
+	if len(env.errs) > 0 {
+		return nil, errors.Join(env.errs...)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseAttrs splits a value followed by semicolon separated attributes, e.g. "http://localhost:8081;weight=3;pool=api"
+func parseAttrs(value string) (string, map[string]string) {
+	value, rawAttrs, _ := strings.Cut(value, ";")
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(rawAttrs, ";") {
+		if attr == "" {
+			continue
+		}
+		key, val, _ := strings.Cut(attr, "=")
+		attrs[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return value, attrs
+}
+
+// parseBackend parses a backend URL optionally followed by attributes, e.g. "http://localhost:8081;weight=3;pool=api".
+// It returns the backend along with the name of its pool
+func parseBackend(value string) (Backend, string, error) {
+	rawUrl, attrs := parseAttrs(value)
+	backend := Backend{URL: rawUrl, Weight: 1}
+	pool := DefaultPoolName
+	for key, val := range attrs {
+		switch key {
+		case "weight":
+			weight, err := strconv.Atoi(val)
+			if err != nil || weight <= 0 {
+				return Backend{}, "", fmt.Errorf("invalid weight %q", val)
+			}
+			backend.Weight = weight
+		case "pool":
+			pool = val
+		default:
+			return Backend{}, "", fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	return backend, pool, nil
+}
+
+// parseRoute parses a route pattern followed by attributes,
+// e.g. "/api/;pool=api", "/;pool=acme;match=header:X-Tenant=acme;priority=10" or "/;split=stable:95,canary:5"
+func parseRoute(name string, value string) (Route, error) {
+	pattern, attrs := parseAttrs(value)
+	route := Route{Name: name, Path: pattern}
+	var rewrite Rewrite
+	for key, val := range attrs {
+		switch key {
+		case "pool":
+			route.Pool = val
+		case "vhost":
+			route.VirtualHost = val
+		case "match":
+			route.Match = val
+		case "priority":
+			priority, err := strconv.Atoi(val)
+			if err != nil {
+				return Route{}, fmt.Errorf("invalid priority %q", val)
+			}
+			route.Priority = priority
+		case "split":
+			split, err := parseSplit(val)
+			if err != nil {
+				return Route{}, err
+			}
+			route.Split = split
+		case "split_key":
+			route.SplitKey = val
+		case "split_override":
+			route.SplitOverride = val
+		case "mirror":
+			if route.Mirror == nil {
+				route.Mirror = &RouteMirror{}
+			}
+			route.Mirror.Pool = val
+		case "mirror_percent":
+			percent, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return Route{}, fmt.Errorf("invalid mirror percentage %q", val)
+			}
+			if route.Mirror == nil {
+				route.Mirror = &RouteMirror{}
+			}
+			route.Mirror.Percent = &percent
+		case "strip_prefix":
+			rewrite.StripPrefix = val
+		case "add_prefix":
+			rewrite.AddPrefix = val
+		case "rewrite_regex":
+			rewrite.Regex = val
+		case "rewrite_replace":
+			rewrite.Replace = val
+		case "redirect":
+			redirect, err := proxy.ParseRedirect(val)
+			if err != nil {
+				return Route{}, err
+			}
+			route.Redirect = &Redirect{Status: redirect.Status, Location: redirect.Location}
+		default:
+			return Route{}, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	if rewrite != (Rewrite{}) {
+		route.Rewrite = &rewrite
+	}
+	return route, nil
+}
+
+// parseSplit parses the list of pools with their weights, e.g. "stable:95,canary:5"
+func parseSplit(value string) ([]SplitTarget, error) {
+	var targets []SplitTarget
+	for _, target := range strings.Split(value, ",") {
+		pool, rawWeight, _ := strings.Cut(strings.TrimSpace(target), ":")
+		weight, err := strconv.Atoi(rawWeight)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight of pool %s %q", pool, rawWeight)
+		}
+		targets = append(targets, SplitTarget{Pool: pool, Weight: weight})
+	}
+	return targets, nil
+}
+
+// parseVirtualHost parses a comma separated list of host names followed by attributes,
+// e.g. "example.com,*.example.com;pool=web". The pool serves the requests not matched by any route of the virtual host
+func parseVirtualHost(value string) (*VirtualHost, error) {
+	hosts, attrs := parseAttrs(value)
+	vhost := &VirtualHost{Hosts: splitList(hosts)}
+	for key, val := range attrs {
+		switch key {
+		case "pool":
+			vhost.Pool = val
+		default:
+			return nil, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	return vhost, nil
+}
+
+// parseListener parses a listener address followed by its attributes, e.g. ":8443;cert=server.crt;key=server.key;routes=api".
+// Several certificates are separated by commas, the first one being the default
+func parseListener(name string, value string) (Listener, error) {
+	address, attrs := parseAttrs(value)
+	listener := Listener{Name: name, Address: strings.TrimSpace(address)}
+	var certs, keys []string
+	for key, val := range attrs {
+		switch key {
+		case "cert":
+			certs = splitList(val)
+		case "key":
+			keys = splitList(val)
+		case "routes":
+			listener.Routes = splitList(val)
+		default:
+			return Listener{}, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	if len(certs) != len(keys) {
+		return Listener{}, fmt.Errorf("every certificate needs a key")
+	}
+	if len(certs) > 0 {
+		listener.TLS = &TLS{CertFile: certs[0], KeyFile: keys[0]}
+		for i := 1; i < len(certs); i++ {
+			listener.TLS.Certificates = append(listener.TLS.Certificates, Certificate{CertFile: certs[i], KeyFile: keys[i]})
+		}
+	}
+	return listener, nil
+}
+
+// parseBackendTLS parses the TLS settings of a pool, e.g. "ca=ca.pem;server_name=api.internal;pins=sha256/AbC...=;min_version=1.2".
+// The CA files and the pins are separated by commas
+func parseBackendTLS(value string) (*BackendTLS, error) {
+	// There is no leading value, all the settings are attributes
+	_, attrs := parseAttrs(";" + value)
+	tls := &BackendTLS{}
+	for key, val := range attrs {
+		switch key {
+		case "ca":
+			tls.CAFiles = splitList(val)
+		case "server_name":
+			tls.ServerName = val
+		case "pins":
+			tls.Pins = splitList(val)
+		case "min_version":
+			tls.MinVersion = val
+		case "cert":
+			tls.CertFile = val
+		case "key":
+			tls.KeyFile = val
+		default:
+			return nil, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	return tls, nil
+}
+
+// envReader reads typed environment variables, collecting the parse errors
+type envReader struct {
+	errs []error
+}
+
+// int returns the integer value of the environment variable or the default if it is not set
+func (e *envReader) int(key string, def int) int {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, str))
+	}
+	return v
+}
+
+// ints returns the comma separated integer values of the environment variable
+func (e *envReader) ints(key string) []int {
+	var values []int
+	for _, v := range envList(key) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, v))
+		}
+		values = append(values, i)
+	}
+	return values
+}
+
+// seconds returns the duration in seconds from the environment variable or the default if it is not set
+func (e *envReader) seconds(key string, def int) Duration {
+	return Duration(time.Duration(e.int(key, def)) * time.Second)
+}
+
+// envOrDefault returns the value of the environment variable or the default if it is not set
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList returns the comma separated values of the environment variable
+func envList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+// splitList returns the non-empty values of the comma separated list
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("HTTP_SERVER_URL_1", "http://localhost:8081;weight=3")
+	t.Setenv("HTTPS_SERVER_URL_1", "https://localhost:8444")
+	t.Setenv("HTTP_SERVER_URL_2", "http://localhost:9081;pool=api")
+	t.Setenv("ROUTE_api", "/api/;pool=api;strip_prefix=/api;mirror=default;mirror_percent=5")
+	t.Setenv("ROUTE_web", "/;split=default:90,api:10;split_key=cookie:session")
+	t.Setenv("VHOST_acme", "acme.com,*.acme.com;pool=api")
+	t.Setenv("AUTH_TOKEN_1", "secret")
+	t.Setenv("GRACEFUL_SHUTDOWN_TIMEOUT_SEC", "5")
+	t.Setenv("RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("LISTENER_public", "[::]:8443;cert=a.crt,b.crt;key=a.key,b.key;routes=web")
+	t.Setenv("LISTENER_internal", "unix:/run/proxy.sock")
+	t.Setenv("POOL_TLS_api", "server_name=api.internal;min_version=1.3;pins=sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatalf("Failed to read configuration: %v", err)
+	}
+
+	if pool := cfg.Pools["default"]; len(pool.HTTPBackends) != 1 || pool.HTTPBackends[0].Weight != 3 || len(pool.HTTPSBackends) != 1 {
+		t.Errorf("Unexpected default pool %+v", pool)
+	}
+	if len(cfg.Routes) != 2 || cfg.Routes[0].Name != "api" || cfg.Routes[1].Name != "web" {
+		t.Fatalf("Expected routes sorted by name, got %+v", cfg.Routes)
+	}
+	if api := cfg.Routes[0]; api.Rewrite.StripPrefix != "/api" || api.Mirror.Pool != "default" || *api.Mirror.Percent != 5 {
+		t.Errorf("Unexpected api route %+v", api)
+	}
+	if web := cfg.Routes[1]; len(web.Split) != 2 || web.Split[1] != (SplitTarget{Pool: "api", Weight: 10}) {
+		t.Errorf("Unexpected web route %+v", web)
+	}
+	if tls := cfg.Pools["api"].TLS; tls == nil || tls.ServerName != "api.internal" || tls.MinVersion != "1.3" || len(tls.Pins) != 1 {
+		t.Errorf("Unexpected TLS settings of the api pool %+v", tls)
+	}
+	if vhost := cfg.VirtualHosts["acme"]; len(vhost.Hosts) != 2 || vhost.Pool != "api" {
+		t.Errorf("Unexpected virtual host %+v", vhost)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[0].Name != "internal" || cfg.Listeners[0].TLS != nil {
+		t.Fatalf("Expected the listeners to replace the default ones, got %+v", cfg.Listeners)
+	}
+	if public := cfg.Listeners[1]; public.TLS.CertFile != "a.crt" || len(public.TLS.Certificates) != 1 || public.TLS.Certificates[0].KeyFile != "b.key" || !public.Serves("web") || public.Serves("api") {
+		t.Errorf("Unexpected public listener %+v", public)
+	}
+	if len(cfg.Auth.Tokens) != 1 || time.Duration(cfg.Timeouts.GracefulShutdown) != 5*time.Second || cfg.Retry.MaxAttempts != 3 {
+		t.Errorf("Unexpected settings %+v %+v %+v", cfg.Auth, cfg.Timeouts, cfg.Retry)
+	}
+}
+
+func TestFromEnv_UnknownTLSPool(t *testing.T) {
+	t.Setenv("HTTP_SERVER_URL_1", "http://localhost:8081")
+	t.Setenv("POOL_TLS_api", "min_version=1.2")
+
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("Expected an error for an unknown pool")
+	}
+}
+
+func TestFromEnv_InvalidRoute(t *testing.T) {
+	t.Setenv("HTTP_SERVER_URL_1", "http://localhost:8081")
+	t.Setenv("ROUTE_api", "/api/;pool=apii")
+
+	if _, err := FromEnv(); err == nil {
+		t.Errorf("Expected an error for an unknown pool")
+	}
+}
+
+func TestFromEnv_NonPositiveHealthCheckInterval(t *testing.T) {
+	t.Setenv("HTTP_SERVER_URL_1", "http://localhost:8081")
+	t.Setenv("HEALTH_CHECK_INTERVAL_SEC", "0")
+
+	// The interval is only used when the health checks are enabled
+	if _, err := FromEnv(); err != nil {
+		t.Errorf("Expected the interval to be ignored without health checks, got %v", err)
+	}
+
+	t.Setenv("HEALTH_CHECK_PATH", "/health")
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "health_check.interval") {
+		t.Errorf("Expected an error for a non-positive interval, got %v", err)
+	}
+}
+
+func TestFromEnv_InvalidBackend(t *testing.T) {
+	t.Setenv("HTTP_SERVER_URL_1", "http://localhost:8081")
+	t.Setenv("HTTP_SERVER_URL_2", "http://localhost:8082;weight=0")
+
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "HTTP_SERVER_URL_2") {
+		t.Errorf("Expected an error for the invalid backend, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolate replaces the references to environment variables in the scalar values of the document:
+// "${NAME}" is replaced by the variable, which must be set, "${NAME:-default}" falls back to the default
+// if the variable is not set or empty, and "$$" is replaced by a single "$". Numeric references such as "${1}" are
+// kept as is, since they refer to the capture groups of the rewrite replacements. References to named capture groups
+// are written "$${name}"
+func interpolate(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		value, err := expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.Line, err)
+		}
+		node.Value = value
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := interpolate(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expand(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			name, def, hasDefault := strings.Cut(s[i+2:i+end], ":-")
+			// Variable names don't start with a digit, so it's a capture group reference
+			if name != "" && name[0] >= '0' && name[0] <= '9' {
+				b.WriteString(s[i : i+end+1])
+				s = s[i+end+1:]
+				continue
+			}
+			value := os.Getenv(name)
+			if value == "" {
+				if _, set := os.LookupEnv(name); !set && !hasDefault {
+					return "", fmt.Errorf("environment variable %s is not set", name)
+				}
+				value = def
+			}
+			b.WriteString(value)
+			s = s[i+end+1:]
+		default:
+			// Other dollars are kept as is, e.g. the "$1" references of the rewrite replacements
+			b.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
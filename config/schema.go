@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var typeOfConfig = reflect.TypeOf(Config{})
+
+// checkFields reports the first key of the document that isn't a field of the configuration,
+// which is most likely a typo that would otherwise be silently ignored
+func checkFields(node *yaml.Node, path string, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := checkFields(child, path, t); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				field, ok := fields[key.Value]
+				if !ok {
+					return fmt.Errorf("line %d: unknown field %s", key.Line, joinPath(path, key.Value))
+				}
+				if err := checkFields(node.Content[i+1], joinPath(path, key.Value), field.Type); err != nil {
+					return err
+				}
+			}
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if err := checkFields(node.Content[i+1], joinPath(path, node.Content[i].Value), t.Elem()); err != nil {
+					return err
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for i, child := range node.Content {
+				if err := checkFields(child, fmt.Sprintf("%s[%d]", path, i), t.Elem()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// Type mismatches are reported by the decoder
+	return nil
+}
+
+// yamlFields returns the fields of the struct by their YAML name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,336 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"pr/proxy"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validator collects the problems of the configuration along with the path of the setting
+type validator struct {
+	errs []error
+}
+
+func (v *validator) addf(path string, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// Validate reports all the problems of the configuration, one per line, e.g. `routes[1].pool: unknown pool "apii"`
+func (c *Config) Validate() error {
+	v := &validator{}
+	c.validateListeners(v)
+	c.validatePools(v)
+	c.validateVirtualHosts(v)
+	c.validateRoutes(v)
+	c.validatePolicies(v)
+	return errors.Join(v.errs...)
+}
+
+func (c *Config) validateListeners(v *validator) {
+	if len(c.Listeners) == 0 {
+		v.addf("listeners", "at least one listener is required")
+	}
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if l.Name != "" {
+			if names[l.Name] {
+				v.addf(path+".name", "duplicate listener %q", l.Name)
+			}
+			names[l.Name] = true
+		}
+		if err := validateAddress(l); err != nil {
+			v.addf(path+".address", "%v", err)
+		} else if addresses[l.Address] {
+			v.addf(path+".address", "duplicate address %q", l.Address)
+		}
+		addresses[l.Address] = true
+		if l.TLS != nil {
+			if len(l.TLS.All()) == 0 {
+				v.addf(path+".tls", "at least one certificate is required")
+			}
+			if l.TLS.CertFile == "" && l.TLS.KeyFile != "" || l.TLS.CertFile != "" && l.TLS.KeyFile == "" {
+				v.addf(path+".tls", "both cert_file and key_file are required")
+			}
+			for j, cert := range l.TLS.Certificates {
+				if cert.CertFile == "" || cert.KeyFile == "" {
+					v.addf(fmt.Sprintf("%s.tls.certificates[%d]", path, j), "both cert_file and key_file are required")
+				}
+			}
+		}
+		for j, route := range l.Routes {
+			if !slices.ContainsFunc(c.Routes, func(r Route) bool { return r.Name == route }) {
+				v.addf(fmt.Sprintf("%s.routes[%d]", path, j), "unknown route %q", route)
+			}
+		}
+	}
+	if c.Admin.Address != "" {
+		if err := validateAddress(Listener{Address: c.Admin.Address}); err != nil {
+			v.addf("admin.address", "%v", err)
+		} else if addresses[c.Admin.Address] {
+			v.addf("admin.address", "address %q is already used by a listener", c.Admin.Address)
+		}
+	}
+
+	timeouts := []struct {
+		name string
+		d    Duration
+	}{
+		{"graceful_shutdown", c.Timeouts.GracefulShutdown},
+		{"read_header", c.Timeouts.ReadHeader},
+		{"read", c.Timeouts.Read},
+		{"write", c.Timeouts.Write},
+		{"idle", c.Timeouts.Idle},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			v.addf("timeouts."+t.name, "must not be negative")
+		}
+	}
+}
+
+// validateAddress checks that the listener address is a TCP address with a port or the path of a Unix socket
+func validateAddress(l Listener) error {
+	network, address := l.Network()
+	if address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if network == "unix" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		return fmt.Errorf("invalid address %q, expected host:port or unix:path", address)
+	}
+	return nil
+}
+
+func (c *Config) validatePools(v *validator) {
+	if _, err := proxy.NewBalancer(c.LoadBalancer, c.HashKey); err != nil {
+		v.addf("load_balancer", "%v", err)
+	}
+	for _, name := range sortedKeys(c.Pools) {
+		pool := c.Pools[name]
+		path := "pools." + name
+		if pool == nil || len(pool.HTTPBackends)+len(pool.HTTPSBackends) == 0 {
+			v.addf(path, "at least one backend is required")
+			continue
+		}
+		if pool.LoadBalancer != "" || pool.HashKey != "" {
+			if _, err := proxy.NewBalancer(c.PoolBalancer(name)); err != nil {
+				v.addf(path+".load_balancer", "%v", err)
+			}
+		}
+		validateBackends(v, path+".http_backends", pool.HTTPBackends)
+		validateBackends(v, path+".https_backends", pool.HTTPSBackends)
+		if pool.TLS != nil {
+			// The files are loaded, so missing or invalid certificates are reported before the proxy starts
+			if _, err := proxy.NewBackendTLSConfig(pool.TLS.ProxyConfig()); err != nil {
+				v.addf(path+".tls", "%v", err)
+			}
+		}
+	}
+}
+
+func validateBackends(v *validator, path string, backends []Backend) {
+	for i, b := range backends {
+		path := fmt.Sprintf("%s[%d]", path, i)
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			v.addf(path+".url", "invalid URL %q", b.URL)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addf(path+".url", "URL %q must be absolute with the http or https scheme", b.URL)
+		}
+		if b.Weight < 0 {
+			v.addf(path+".weight", "must not be negative")
+		}
+	}
+}
+
+func (c *Config) validateVirtualHosts(v *validator) {
+	owners := make(map[string]string)
+	for _, name := range sortedKeys(c.VirtualHosts) {
+		vhost := c.VirtualHosts[name]
+		path := "virtual_hosts." + name
+		if vhost == nil || len(vhost.Hosts) == 0 {
+			v.addf(path+".hosts", "at least one host is required")
+			continue
+		}
+		for i, host := range vhost.Hosts {
+			if err := proxy.NewVirtualHosts(nil).AddHost(host, nil); err != nil {
+				v.addf(fmt.Sprintf("%s.hosts[%d]", path, i), "%v", err)
+			}
+			if owner, ok := owners[strings.ToLower(host)]; ok && owner != name {
+				v.addf(fmt.Sprintf("%s.hosts[%d]", path, i), "host %q already belongs to virtual host %s", host, owner)
+			}
+			owners[strings.ToLower(host)] = name
+		}
+		if vhost.Pool != "" && c.Pools[vhost.Pool] == nil {
+			v.addf(path+".pool", "unknown pool %q", vhost.Pool)
+		}
+	}
+	if c.DefaultVirtualHost != "" && c.DefaultVirtualHost != "none" && c.VirtualHosts[c.DefaultVirtualHost] == nil {
+		v.addf("default_virtual_host", "unknown virtual host %q", c.DefaultVirtualHost)
+	}
+	if c.UnknownHostStatus < 100 || c.UnknownHostStatus > 599 {
+		v.addf("unknown_host_status", "invalid status %d", c.UnknownHostStatus)
+	}
+}
+
+func (c *Config) validateRoutes(v *validator) {
+	names := make(map[string]bool)
+	for i, route := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		if route.Name == "" {
+			v.addf(path+".name", "name is required")
+		} else if names[route.Name] {
+			v.addf(path+".name", "duplicate route %q", route.Name)
+		}
+		names[route.Name] = true
+
+		if _, err := proxy.NewRoute(route.Name, route.Path, nil); err != nil {
+			v.addf(path+".path", "%v", err)
+		}
+		switch {
+		case route.Pool == "" && len(route.Split) == 0 && route.Redirect == nil:
+			v.addf(path, "one of pool, split or redirect is required")
+		case route.Pool != "" && c.Pools[route.Pool] == nil:
+			v.addf(path+".pool", "unknown pool %q", route.Pool)
+		}
+		if route.VirtualHost != "" && c.VirtualHosts[route.VirtualHost] == nil {
+			v.addf(path+".virtual_host", "unknown virtual host %q", route.VirtualHost)
+		}
+		if route.Match != "" {
+			if _, err := proxy.ParsePredicate(route.Match); err != nil {
+				v.addf(path+".match", "%v", err)
+			}
+		}
+		c.validateSplit(v, path, route)
+		if route.Mirror != nil {
+			if c.Pools[route.Mirror.Pool] == nil {
+				v.addf(path+".mirror.pool", "unknown pool %q", route.Mirror.Pool)
+			}
+			if p := route.Mirror.Percent; p != nil && (*p < 0 || *p > 100) {
+				v.addf(path+".mirror.percent", "must be between 0 and 100")
+			}
+		}
+		if rw := route.Rewrite; rw != nil {
+			if _, err := proxy.NewRewrite(rw.StripPrefix, rw.AddPrefix, rw.Regex, rw.Replace); err != nil {
+				v.addf(path+".rewrite.regex", "%v", err)
+			}
+		}
+		if route.Redirect != nil {
+			if _, err := proxy.ParseRedirect(strconv.Itoa(route.Redirect.Status)); err != nil {
+				v.addf(path+".redirect.status", "%v", err)
+			}
+			if location := route.Redirect.Location; location != "" {
+				if u, err := url.Parse(location); err != nil || u.Scheme == "" || u.Host == "" {
+					v.addf(path+".redirect.location", "location %q must be an absolute URL", location)
+				}
+			}
+		}
+	}
+}
+
+func (c *Config) validateSplit(v *validator, path string, route Route) {
+	if len(route.Split) == 0 {
+		if route.SplitKey != "" || route.SplitOverride != "" {
+			v.addf(path+".split", "split is required by split_key and split_override")
+		}
+		return
+	}
+	if len(route.Split) < 2 {
+		v.addf(path+".split", "at least two pools are required")
+	}
+	total := 0
+	for i, target := range route.Split {
+		if c.Pools[target.Pool] == nil {
+			v.addf(fmt.Sprintf("%s.split[%d].pool", path, i), "unknown pool %q", target.Pool)
+		}
+		if target.Weight < 0 {
+			v.addf(fmt.Sprintf("%s.split[%d].weight", path, i), "must not be negative")
+		}
+		total += target.Weight
+	}
+	if total <= 0 {
+		v.addf(path+".split", "at least one weight must be positive")
+	}
+	if route.SplitKey != "" {
+		if _, err := proxy.ParseHashKey(route.SplitKey); err != nil {
+			v.addf(path+".split_key", "%v", err)
+		}
+	}
+}
+
+func (c *Config) validatePolicies(v *validator) {
+	if hc := c.HealthCheck; hc.Path != "" {
+		if !strings.HasPrefix(hc.Path, "/") {
+			v.addf("health_check.path", "must start with /")
+		}
+		if hc.Interval <= 0 {
+			v.addf("health_check.interval", "must be positive")
+		}
+		if hc.Timeout <= 0 {
+			v.addf("health_check.timeout", "must be positive")
+		}
+		if hc.HealthyThreshold < 1 || hc.UnhealthyThreshold < 1 {
+			v.addf("health_check", "thresholds must be at least 1")
+		}
+	}
+	if p := c.OutlierDetection.ErrorRatePercent; p < 0 || p > 100 {
+		v.addf("outlier_detection.error_rate_percent", "must be between 0 and 100")
+	}
+	if c.OutlierDetection.ConsecutiveFailures < 0 {
+		v.addf("outlier_detection.consecutive_failures", "must not be negative")
+	}
+	if p := c.Retry.BudgetPercent; p < 0 || p > 100 {
+		v.addf("retry.budget_percent", "must be between 0 and 100")
+	}
+	if p := c.Hedge.Percentile; p < 0 || p >= 100 {
+		v.addf("hedge.percentile", "must be between 0 and 99")
+	}
+	if p := c.Hedge.BudgetPercent; p < 0 || p > 100 {
+		v.addf("hedge.budget_percent", "must be between 0 and 100")
+	}
+	if c.WebSocket.DialAttempts < 0 {
+		v.addf("websocket.dial_attempts", "must not be negative")
+	}
+	if c.Transport.MaxIdleConns < 0 {
+		v.addf("transport.max_idle_conns", "must not be negative")
+	}
+	if c.Transport.MaxConnsPerHost < 0 {
+		v.addf("transport.max_conns_per_host", "must not be negative")
+	}
+	transportTimeouts := []struct {
+		name string
+		d    Duration
+	}{
+		{"idle_timeout", c.Transport.IdleTimeout},
+		{"dial_timeout", c.Transport.DialTimeout},
+		{"tls_handshake_timeout", c.Transport.TLSHandshakeTimeout},
+	}
+	for _, t := range transportTimeouts {
+		if t.d < 0 {
+			v.addf("transport."+t.name, "must not be negative")
+		}
+	}
+	if c.Mirror.MaxConcurrent < 1 {
+		v.addf("mirror.max_concurrent", "must be at least 1")
+	}
+}
+
+// sortedKeys returns the keys of the map in order, so the problems are reported in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
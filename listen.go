@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"pr/config"
+	"syscall"
+)
+
+// listen opens the listener address, wrapped with TLS if the listener has certificates
+func listen(l config.Listener) (net.Listener, error) {
+	network, address := l.Network()
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if l.TLS == nil {
+		return ln, nil
+	}
+
+	tlsConfig, err := listenerTLSConfig(l.TLS)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// removeStaleSocket removes the socket left behind by a process that didn't exit cleanly, which would make
+// the address unusable. A socket still accepting connections belongs to a running process and is kept
+func removeStaleSocket(address string) error {
+	info, err := os.Stat(address)
+	if err != nil || info.Mode().Type() != fs.ModeSocket {
+		return nil
+	}
+	conn, err := net.Dial("unix", address)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen unix %s: address already in use", address)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(address)
+}
+
+// listenerTLSConfig loads the certificates of the listener. The certificate is chosen by the server name
+// the client asks for, the first one being used when none matches
+func listenerTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	for _, c := range cfg.All() {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate %s: %v", c.CertFile, err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	return tlsConfig, nil
+}
+
+// isLoopback reports whether the address only accepts local connections
+func isLoopback(l config.Listener) bool {
+	network, address := l.Network()
+	if network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"pr/config"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for the name and returns its files
+func writeTestCert(t *testing.T, dir string, name string) config.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := config.Certificate{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	os.WriteFile(cert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(cert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return cert
+}
+
+// socketPath returns a path short enough for a Unix socket, which the test temp directories might not be
+func socketPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "pr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "proxy.sock")
+}
+
+func TestListen_Unix(t *testing.T) {
+	path := socketPath(t)
+	ln, err := listen(config.Listener{Address: "unix:" + path})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("Expected the connection to be accepted, got %q %v", buf, err)
+	}
+}
+
+func TestListen_StaleSocket(t *testing.T) {
+	path := socketPath(t)
+	listener := config.Listener{Address: "unix:" + path}
+
+	// A socket in use belongs to a running process and must not be taken over
+	running, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(listener); err == nil {
+		ln.Close()
+		t.Fatalf("Expected an error for a socket in use")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the socket in use to be kept, got %v", err)
+	}
+
+	// The socket of a process that didn't exit cleanly refuses the connections
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	ln, err := listen(listener)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+
+	// Files other than sockets are never removed
+	os.WriteFile(path, []byte("data"), 0o600)
+	if ln, err := listen(listener); err == nil {
+		ln.Close()
+		t.Fatalf("Expected an error for a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the regular file to be kept, got %v", err)
+	}
+}
+
+func TestListen_SelectsCertificateByServerName(t *testing.T) {
+	dir := t.TempDir()
+	def := writeTestCert(t, dir, "default.example.com")
+	ln, err := listen(config.Listener{Address: "127.0.0.1:0", TLS: &config.TLS{
+		CertFile:     def.CertFile,
+		KeyFile:      def.KeyFile,
+		Certificates: []config.Certificate{writeTestCert(t, dir, "api.example.com"), writeTestCert(t, dir, "ws.example.com")},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	tests := map[string]string{
+		"api.example.com":     "api.example.com",
+		"ws.example.com":      "ws.example.com",
+		"unknown.example.com": "default.example.com",
+	}
+	for serverName, expected := range tests {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Failed to connect to %q: %v", serverName, err)
+		}
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Errorf("Expected the certificate of %s for %q, got %s", expected, serverName, name)
+		}
+		conn.Close()
+	}
+
+	if _, err := listenerTLSConfig(&config.TLS{}); err == nil {
+		t.Errorf("Expected an error without certificates")
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := map[string]bool{
+		"localhost:8080":       true,
+		"127.0.0.1:8080":       true,
+		"[::1]:8080":           true,
+		"unix:/run/proxy.sock": true,
+		"0.0.0.0:8080":         false,
+		":8080":                false,
+		"10.0.0.1:8080":        false,
+		"example.com:8080":     false,
+	}
+	for address, expected := range tests {
+		if loopback := isLoopback(config.Listener{Address: address}); loopback != expected {
+			t.Errorf("Expected isLoopback(%q) to be %v, got %v", address, expected, loopback)
+		}
+	}
+}
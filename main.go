@@ -2,151 +2,390 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"pr/config"
 	"pr/middleware"
 	"pr/proxy"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
-func parseEnvVars() ([]*url.URL, []*url.URL, map[string]struct{}) {
-
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+// loadConfig reads the configuration file, or the environment variables if there is no file
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return config.FromEnv()
 	}
+	return config.Load(path)
+}
 
-	var httpUrls []*url.URL
-	var httpsUrls []*url.URL
-	validTokens := make(map[string]struct{})
-
-	envVars := os.Environ()
+// buildPools creates the backend pools and starts their health checks. The backends take over the state of the
+// previous backends with the same URL, if any, e.g. on a reload
+func buildPools(ctx context.Context, cfg *config.Config, previous map[string]*proxy.Backend) (map[string]*proxy.ServerPool, error) {
+	outlierDetectionConfig := proxy.OutlierDetectionConfig{
+		ConsecutiveFailures: cfg.OutlierDetection.ConsecutiveFailures,
+		ErrorRateThreshold:  float64(cfg.OutlierDetection.ErrorRatePercent) / 100,
+		MinRequests:         cfg.OutlierDetection.MinRequests,
+		Window:              time.Duration(cfg.OutlierDetection.Window),
+		Cooldown:            time.Duration(cfg.OutlierDetection.Cooldown),
+		HalfOpenRequests:    cfg.OutlierDetection.HalfOpenRequests,
+	}
+	healthCheckConfig := proxy.HealthCheckConfig{
+		Path:               cfg.HealthCheck.Path,
+		Interval:           time.Duration(cfg.HealthCheck.Interval),
+		Timeout:            time.Duration(cfg.HealthCheck.Timeout),
+		HealthyThreshold:   cfg.HealthCheck.HealthyThreshold,
+		UnhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
+		ExpectedStatuses:   cfg.HealthCheck.ExpectedStatuses,
+		SkipCertCheck:      cfg.SkipCertCheck,
+	}
 
-	for _, envVar := range envVars {
-		parts := strings.SplitN(envVar, "=", 2)
-		if len(parts) != 2 {
-			continue
+	pools := make(map[string]*proxy.ServerPool)
+	for name, poolCfg := range cfg.Pools {
+		httpBackends, err := buildBackends(poolCfg.HTTPBackends)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		httpsBackends, err := buildBackends(poolCfg.HTTPSBackends)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
 		}
-		key, value := parts[0], parts[1]
 
-		if strings.HasPrefix(key, "HTTP_SERVER_URL_") {
-			url, err := url.Parse(value)
+		pool := proxy.NewServerPool(httpBackends, httpsBackends)
+		// Every pool needs its own balancer, since balancers keep the state of their backends
+		balancer, err := proxy.NewBalancer(cfg.PoolBalancer(name))
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		pool.SetBalancer(balancer)
+		if poolCfg.TLS != nil {
+			tlsConfig, err := proxy.NewBackendTLSConfig(poolCfg.TLS.ProxyConfig())
 			if err != nil {
-				log.Printf("Error parsing URL %s: %v", value, err)
-				continue
+				return nil, fmt.Errorf("pool %s: %v", name, err)
+			}
+			pool.SetTLSConfig(tlsConfig)
+		}
+		if outlierDetectionConfig.Enabled() {
+			pool.EnableOutlierDetection(outlierDetectionConfig)
+		}
+		for _, b := range pool.Backends() {
+			if p := previous[b.URL.String()]; p != nil {
+				b.CopyState(p, healthCheckConfig.Path != "")
 			}
+		}
+		if healthCheckConfig.Path != "" {
+			pool.StartHealthChecks(ctx, healthCheckConfig)
+		}
+		pools[name] = pool
+	}
+	return pools, nil
+}
 
-			httpUrls = append(httpUrls, url)
-		} else if strings.HasPrefix(key, "HTTPS_SERVER_URL_") {
-			url, err := url.Parse(value)
-			if err != nil {
-				log.Printf("Error parsing URL %s: %v", value, err)
-				continue
+func buildBackends(backends []config.Backend) ([]*proxy.Backend, error) {
+	var result []*proxy.Backend
+	for _, b := range backends {
+		u, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, proxy.NewBackend(u, max(b.Weight, 1)))
+	}
+	return result, nil
+}
+
+// buildRoutes creates the routes in the order of the configuration. It also returns the traffic splits and mirrors by route name
+func buildRoutes(cfg *config.Config, pools map[string]*proxy.ServerPool, diffLog *proxy.DiffLog) ([]*proxy.Route, map[string]*proxy.TrafficSplit, map[string]*proxy.Mirror, error) {
+	var routes []*proxy.Route
+	splits := make(map[string]*proxy.TrafficSplit)
+	mirrors := make(map[string]*proxy.Mirror)
+	for _, route := range cfg.Routes {
+		r, err := proxy.NewRoute(route.Name, route.Path, pools[route.Pool])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if route.Match != "" {
+			if r.Predicate, err = proxy.ParsePredicate(route.Match); err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s: %v", route.Name, err)
 			}
+		}
+		r.Priority = route.Priority
+		if rw := route.Rewrite; rw != nil {
+			if r.Rewrite, err = proxy.NewRewrite(rw.StripPrefix, rw.AddPrefix, rw.Regex, rw.Replace); err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s: %v", route.Name, err)
+			}
+		}
+		if rd := route.Redirect; rd != nil {
+			if r.Redirect, err = proxy.ParseRedirect(fmt.Sprintf("%d:%s", rd.Status, rd.Location)); err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s: %v", route.Name, err)
+			}
+		}
+		if len(route.Split) > 0 {
+			if r.Split, err = buildTrafficSplit(route, pools); err != nil {
+				return nil, nil, nil, fmt.Errorf("route %s: %v", route.Name, err)
+			}
+			splits[route.Name] = r.Split
+		}
+		if route.Mirror != nil {
+			percent := 100.0
+			if route.Mirror.Percent != nil {
+				percent = *route.Mirror.Percent
+			}
+			r.Mirror = proxy.NewMirror(pools[route.Mirror.Pool], proxy.MirrorConfig{
+				Percent:       percent,
+				MaxBodySize:   cfg.Mirror.MaxBodySize,
+				Timeout:       time.Duration(cfg.Mirror.Timeout),
+				MaxConcurrent: cfg.Mirror.MaxConcurrent,
+				SkipCertCheck: cfg.SkipCertCheck,
+			})
+			if diffLog != nil {
+				r.Mirror.Diff = proxy.NewResponseDiff(route.Name, proxy.DiffConfig{
+					Headers:      cfg.Mirror.DiffHeaders,
+					IgnoreFields: cfg.Mirror.DiffIgnoreFields,
+					MaxBodySize:  cfg.Mirror.DiffMaxBodySize,
+				}, diffLog)
+			}
+			mirrors[route.Name] = r.Mirror
+		}
+		routes = append(routes, r)
+	}
+	return routes, splits, mirrors, nil
+}
 
-			httpsUrls = append(httpsUrls, url)
-		} else if strings.HasPrefix(key, "AUTH_TOKEN_") {
-			validTokens[value] = struct{}{}
+// buildVirtualHosts creates the virtual hosts of the listener and their routing tables, with the routes served by the listener.
+// Routes without virtual host belong to the default virtual host, which serves the requests to unknown hosts
+// unless another virtual host is the default or it's set to "none". The routes are shared by the listeners,
+// so the traffic splits and mirrors are the same on all of them
+func buildVirtualHosts(cfg *config.Config, pools map[string]*proxy.ServerPool, routes []*proxy.Route, listener config.Listener) (*proxy.VirtualHosts, error) {
+	routers := map[string]*proxy.Router{"": proxy.NewRouter(pools[config.DefaultPoolName])}
+	for name, vhost := range cfg.VirtualHosts {
+		routers[name] = proxy.NewRouter(pools[vhost.Pool])
+	}
+	for i, route := range cfg.Routes {
+		if listener.Serves(route.Name) {
+			routers[route.VirtualHost].Add(routes[i])
 		}
 	}
 
-	return httpUrls, httpsUrls, validTokens
+	var defaultRouter *proxy.Router
+	if cfg.DefaultVirtualHost != "none" {
+		defaultRouter = routers[cfg.DefaultVirtualHost]
+	}
+
+	hosts := proxy.NewVirtualHosts(defaultRouter)
+	for name, vhost := range cfg.VirtualHosts {
+		for _, host := range vhost.Hosts {
+			if err := hosts.AddHost(host, routers[name]); err != nil {
+				return nil, fmt.Errorf("virtual host %s: %v", name, err)
+			}
+		}
+	}
+	hosts.UnknownHostStatus = cfg.UnknownHostStatus
+	return hosts, nil
 }
 
-func main() {
-	httpUrls, httpsUrls, validTokens := parseEnvVars()
-	skipCertCheck := os.Getenv("SKIP_CERT_CHECK") == "true"
-	gracefulShutdownTimeoutStr := os.Getenv("GRACEFUL_SHUTDOWN_TIMEOUT_SEC")
-	if gracefulShutdownTimeoutStr == "" {
-		gracefulShutdownTimeoutStr = "20"
+// buildTrafficSplit creates the traffic split of the route from the list of pools with their weights
+func buildTrafficSplit(route config.Route, pools map[string]*proxy.ServerPool) (*proxy.TrafficSplit, error) {
+	var targets []proxy.SplitTarget
+	var weights []int
+	for _, target := range route.Split {
+		targets = append(targets, proxy.SplitTarget{Name: target.Pool, Pool: pools[target.Pool]})
+		weights = append(weights, target.Weight)
 	}
-	gracefulShutdownTimeout, err := time.ParseDuration(gracefulShutdownTimeoutStr + "s")
-	log.Printf("Proxy pid: %v\n", os.Getpid())
-	log.Printf("gracefulShutdownTimeout: %v\n", gracefulShutdownTimeout)
+
+	split, err := proxy.NewTrafficSplit(targets, weights)
 	if err != nil {
-		log.Fatalf("Error parsing graceful shutdown timeout: %v", err)
+		return nil, err
 	}
+	if route.SplitKey != "" {
+		key, err := proxy.ParseHashKey(route.SplitKey)
+		if err != nil {
+			return nil, err
+		}
+		split.StickyKey = &key
+	}
+	split.OverrideHeader = route.SplitOverride
+	return split, nil
+}
 
-	pool := proxy.NewServerPool(httpUrls, httpsUrls)
+// buildAffinity creates the sticky sessions. It returns nil if they are disabled
+func buildAffinity(cfg *config.Config) *proxy.Affinity {
+	if cfg.StickySession.Cookie == "" {
+		return nil
+	}
+	secret := []byte(cfg.StickySession.Secret)
+	if len(secret) == 0 {
+		// Cookies issued before a restart become invalid and clients are rebalanced
+		log.Printf("Sticky session secret is not set, using a random one")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Error generating sticky session secret: %v", err)
+		}
+	}
+	return proxy.NewAffinity(cfg.StickySession.Cookie, secret)
+}
+
+// buildOptions creates the proxy options shared by all the routes, except the sticky sessions
+func buildOptions(cfg *config.Config) proxy.Options {
+	opts := proxy.Options{
+		SkipCertCheck:         cfg.SkipCertCheck,
+		WebSocketDialAttempts: cfg.WebSocket.DialAttempts,
+		WebSocketDialTimeout:  time.Duration(cfg.WebSocket.DialTimeout),
+		Transports: proxy.NewTransports(proxy.TransportConfig{
+			MaxIdleConns:        cfg.Transport.MaxIdleConns,
+			MaxConnsPerHost:     cfg.Transport.MaxConnsPerHost,
+			IdleTimeout:         time.Duration(cfg.Transport.IdleTimeout),
+			DialTimeout:         time.Duration(cfg.Transport.DialTimeout),
+			TLSHandshakeTimeout: time.Duration(cfg.Transport.TLSHandshakeTimeout),
+		}),
+	}
+
+	if cfg.Retry.MaxAttempts >= 2 {
+		opts.Retry = proxy.NewRetryPolicy(proxy.RetryConfig{
+			MaxAttempts:       cfg.Retry.MaxAttempts,
+			Methods:           cfg.Retry.Methods,
+			Statuses:          cfg.Retry.Statuses,
+			PerTryTimeout:     time.Duration(cfg.Retry.PerTryTimeout),
+			BudgetPercent:     float64(cfg.Retry.BudgetPercent),
+			MaxBodySize:       cfg.Retry.MaxBodySize,
+			IdempotencyHeader: cfg.Retry.IdempotencyHeader,
+		})
+	}
 
-	httpHandler := middleware.LogRequest(middleware.Authorize((proxy.ProxyHandler(pool, false, false, skipCertCheck)), validTokens))
-	httpsHandler := middleware.LogRequest(middleware.Authorize((proxy.ProxyHandler(pool, false, true, skipCertCheck)), validTokens))
-	wsHandler := middleware.LogRequest(middleware.Authorize((proxy.ProxyHandler(pool, true, false, skipCertCheck)), validTokens))
+	if cfg.Hedge.Delay > 0 {
+		opts.Hedge = proxy.NewHedgePolicy(proxy.HedgeConfig{
+			Delay:         time.Duration(cfg.Hedge.Delay),
+			Percentile:    float64(cfg.Hedge.Percentile),
+			BudgetPercent: float64(cfg.Hedge.BudgetPercent),
+		})
+	}
+	return opts
+}
 
-	httpMux := http.NewServeMux()
-	httpMux.HandleFunc("/websocket", wsHandler.ServeHTTP)
-	httpMux.HandleFunc("/", httpHandler.ServeHTTP)
+func main() {
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
 
-	httpsMux := http.NewServeMux()
-	httpsMux.HandleFunc("/websocket", wsHandler.ServeHTTP)
-	httpsMux.HandleFunc("/", httpsHandler.ServeHTTP)
+	configPath := flag.String("config", os.Getenv("PROXY_CONFIG"), "YAML or JSON configuration file. The environment variables are used if not set")
+	watch := flag.Bool("watch", os.Getenv("PROXY_CONFIG_WATCH") == "true", "Reload the configuration file whenever it changes")
+	flag.Parse()
 
-	httpServer := &http.Server{
-		Addr:    ":8080",
-		Handler: httpMux,
+	rl, err := newReloader(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading configuration:\n%v", err)
 	}
-	httpsServer := &http.Server{
-		Addr:    ":8443",
-		Handler: httpsHandler,
+	cfg := rl.config()
+	gracefulShutdownTimeout := time.Duration(cfg.Timeouts.GracefulShutdown)
+	log.Printf("Proxy pid: %v\n", os.Getpid())
+	log.Printf("gracefulShutdownTimeout: %v\n", gracefulShutdownTimeout)
+
+	// The configuration file is watched until the shutdown is initiated
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if *watch && *configPath != "" {
+		if err := rl.watch(watchCtx); err != nil {
+			log.Fatalf("Error watching %s: %v", *configPath, err)
+		}
 	}
 
 	// Channel to receive the shutdown signal
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 
-	// Start the HTTP server in a goroutine
+	// Channel to receive the reload signal
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	go func() {
-		log.Println("Starting HTTP server on :8080")
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			// Log error only if it's not due to graceful shutdown
-			log.Fatalf("HTTP server failed: %v", err)
+		for range reload {
+			log.Printf("Reload signal received")
+			rl.logReload()
 		}
 	}()
 
-	// Start the HTTPS server in a goroutine
-	go func() {
-		log.Println("Starting HTTPS server on :8443")
-		if err := httpsServer.ListenAndServeTLS("server.crt", "server.key"); err != nil && err != http.ErrServerClosed {
-			// Log error only if it's not due to graceful shutdown
-			log.Fatalf("HTTPS server failed: %v", err)
+	// Start every listener in a goroutine. The listeners always serve the requests with the latest configuration
+	var servers []*http.Server
+	for i, listener := range cfg.Listeners {
+		ln, err := listen(listener)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", listener.Address, err)
 		}
-	}()
+		server := &http.Server{
+			Handler:           middleware.LogRequest(rl.handler(i)),
+			ReadHeaderTimeout: time.Duration(cfg.Timeouts.ReadHeader),
+			ReadTimeout:       time.Duration(cfg.Timeouts.Read),
+			WriteTimeout:      time.Duration(cfg.Timeouts.Write),
+			IdleTimeout:       time.Duration(cfg.Timeouts.Idle),
+		}
+		servers = append(servers, server)
+
+		go func() {
+			if listener.TLS != nil {
+				log.Printf("Starting HTTPS server on %s", listener.Address)
+			} else {
+				log.Printf("Starting HTTP server on %s", listener.Address)
+			}
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				// Log error only if it's not due to graceful shutdown
+				log.Fatalf("Server on %s failed: %v", listener.Address, err)
+			}
+		}()
+	}
+
+	// Start the admin server in a goroutine. It should be bound to localhost, since it's not authorized
+	var adminServer *http.Server
+	if cfg.Admin.Address != "" {
+		admin := config.Listener{Name: "admin", Address: cfg.Admin.Address}
+		if !isLoopback(admin) {
+			log.Printf("Admin server is not bound to localhost, its endpoints are reachable without authorization")
+		}
+		ln, err := listen(admin)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", cfg.Admin.Address, err)
+		}
+		adminServer = &http.Server{
+			Handler: middleware.LogRequest(rl.adminHandler()),
+		}
+		go func() {
+			log.Printf("Starting admin server on %s", cfg.Admin.Address)
+			if err := adminServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Admin server failed: %v", err)
+			}
+		}()
+	}
 
 	// Wait for the shutdown signal
 	<-shutdown
 	log.Printf("Shutdown signal received")
+	stopWatching()
+	signal.Stop(reload)
+	rl.stop()
+	if adminServer != nil {
+		adminServer.Close()
+	}
 
 	// Context with a timeout for graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
 	defer cancel()
 
 	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Shut down HTTP server
-	go func() {
-		defer wg.Done()
-		if err := httpServer.Shutdown(ctx); err != nil {
-			log.Fatalf("HTTP server shutdown failed: %v", err)
-		}
-	}()
+	wg.Add(len(servers))
 
-	// Shut down HTTPS server
-	go func() {
-		defer wg.Done()
-		if err := httpsServer.Shutdown(ctx); err != nil {
-			log.Fatalf("HTTPS server shutdown failed: %v", err)
-		}
-	}()
+	// Shut down every server
+	for _, server := range servers {
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Fatalf("Server shutdown failed: %v", err)
+			}
+		}()
+	}
 
 	c := make(chan struct{})
 	go func() {
@@ -161,8 +400,8 @@ func main() {
 	// Or until the context is timed out
 	select {
 	case <-c:
-		log.Println("HTTPS server stopped. All active WS connections have been closed")
+		log.Println("Servers stopped. All active WS connections have been closed")
 	case <-ctx.Done():
-		log.Fatalf("HTTPS server stopped. Some connections might have been terminated")
+		log.Fatalf("Servers stopped. Some connections might have been terminated")
 	}
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildRoutes_RedirectLocationWithTrailingSlash(t *testing.T) {
+	backend := newNamedServer(t, "backend")
+	rl := newTestReloader(t, testConfig(backend.URL)+`
+routes:
+  - name: moved
+    path: /old/
+    redirect:
+      status: 308
+      location: https://new.example.com/
+`)
+
+	req := httptest.NewRequest("GET", "/old/page?q=1", nil)
+	req.Header.Set("X-Auth-Token", "secret")
+	rec := httptest.NewRecorder()
+	rl.handler(0).ServeHTTP(rec, req)
+	if location := rec.Header().Get("Location"); rec.Code != 308 || location != "https://new.example.com/old/page?q=1" {
+		t.Errorf("Expected a redirect to https://new.example.com/old/page?q=1, got %d %q", rec.Code, location)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// AdminHandler returns a handler exposing the runtime controls of the proxy:
+//
+//	GET /splits         - current weights of the traffic splits by route name
+//	PUT /splits/{route} - replaces the weights of the route traffic split, e.g. {"stable": 90, "canary": 10}
+//	GET /mirrors        - request counters of the traffic mirrors by route name
+//
+// The weights set at runtime are not persisted, they only last until the proxy restarts or the split is changed
+// in the configuration
+func AdminHandler(splits map[string]*TrafficSplit, mirrors map[string]*Mirror) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /splits", func(w http.ResponseWriter, r *http.Request) {
+		weights := make(map[string]map[string]int, len(splits))
+		for name, split := range splits {
+			weights[name] = split.Weights()
+		}
+		writeJSON(w, weights)
+	})
+
+	mux.HandleFunc("PUT /splits/{route}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("route")
+		split, ok := splits[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := split.SetWeightsByName(weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Traffic split of route %s changed to %v", name, weights)
+		writeJSON(w, split.Weights())
+	})
+
+	mux.HandleFunc("GET /mirrors", func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]MirrorStats, len(mirrors))
+		for name, mirror := range mirrors {
+			stats[name] = mirror.Stats()
+		}
+		writeJSON(w, stats)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Couldn't write admin response: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"sync"
+)
+
+// Affinity pins clients to backends with a cookie issued by the proxy. The cookie holds an opaque identifier
+// of the backend, so the clients learn nothing about the backend addresses.
+// Requests carrying the cookie bypass the pool balancer unless the pinned backend is unavailable,
+// in which case another backend is picked and the cookie is reissued
+type Affinity struct {
+	CookieName string
+	secret     []byte
+	// ids caches the identifiers of the backend URLs
+	ids sync.Map
+}
+
+// NewAffinity creates a new cookie based session affinity. The secret is used to derive the backend identifiers,
+// so clients can't choose the backend themselves
+func NewAffinity(cookieName string, secret []byte) *Affinity {
+	return &Affinity{CookieName: cookieName, secret: secret}
+}
+
+// pinned returns the backend the request is pinned to if it's still available. The caller must call end
+// on the returned backend once the request is completed
+func (a *Affinity) pinned(pool *ServerPool, r *http.Request, https bool) *Backend {
+	if a == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(a.CookieName)
+	if err != nil {
+		return nil
+	}
+	for _, b := range pool.servers(https) {
+		server := b.URL.String()
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(a.id(server))) == 1 {
+			return pool.Acquire(server, https)
+		}
+	}
+	return nil
+}
+
+// pin adds the cookie pinning the client to the backend to the response headers
+func (a *Affinity) pin(h http.Header, r *http.Request, backend *Backend) {
+	if a == nil {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     a.CookieName,
+		Value:    a.id(backend.URL.String()),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	h.Add("Set-Cookie", cookie.String())
+}
+
+// id returns the identifier of the backend URL, a truncated HMAC of the URL that can't be reversed or forged
+// without the secret
+func (a *Affinity) id(server string) string {
+	if id, ok := a.ids.Load(server); ok {
+		return id.(string)
+	}
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(server))
+	id := base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+	a.ids.Store(server, id)
+	return id
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newAffinityTestServers(t *testing.T) (*httptest.Server, *httptest.Server) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	server1 := httptest.NewServer(handler("server1"))
+	t.Cleanup(server1.Close)
+	server2 := httptest.NewServer(handler("server2"))
+	t.Cleanup(server2.Close)
+	return server1, server2
+}
+
+func TestAffinity_PinsClientToBackend(t *testing.T) {
+	server1, server2 := newAffinityTestServers(t)
+	url1, _ := url.Parse(server1.URL)
+	url2, _ := url.Parse(server2.URL)
+	pool := NewServerPool(testBackends([]*url.URL{url1, url2}), nil)
+	handler := ProxyHandler(pool, false, false, Options{Affinity: NewAffinity("affinity", []byte("secret"))})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "affinity" {
+		t.Fatalf("Expected the affinity cookie, got %v", cookies)
+	}
+	first := rec.Body.String()
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Body.String() != first {
+			t.Fatalf("Expected the request to be pinned to %s, got %s", first, rec.Body.String())
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("The cookie should not be reissued while the backend is available")
+		}
+	}
+
+	// The pinned backend goes down, so the client fails over and gets a new cookie
+	pinned := map[string]*Backend{"server1": pool.httpServers[0], "server2": pool.httpServers[1]}[first]
+	pinned.SetAlive(false)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Body.String() == first {
+		t.Errorf("Expected the request to fail over from %s", first)
+	}
+	if reissued := rec.Result().Cookies(); len(reissued) != 1 || reissued[0].Value == cookies[0].Value {
+		t.Errorf("Expected the cookie to be reissued, got %v", reissued)
+	}
+}
+
+func TestAffinity_RejectsForgedCookie(t *testing.T) {
+	affinity := NewAffinity("affinity", []byte("secret"))
+	forger := NewAffinity("affinity", []byte("another secret"))
+	backendUrl, _ := url.Parse("http://server1.com:8081")
+	pool := NewServerPool(testBackends([]*url.URL{backendUrl}), nil)
+
+	pinned := func(value string) *Backend {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "affinity", Value: value})
+		return affinity.pinned(pool, req, false)
+	}
+	if b := pinned(forger.id(backendUrl.String())); b != nil {
+		t.Errorf("Cookie derived with another secret should be rejected")
+	}
+	if b := pinned(affinity.id(backendUrl.String())); b != pool.httpServers[0] {
+		t.Errorf("Expected the cookie to pin the backend, got %v", b)
+	}
+	if b := pinned("garbage"); b != nil {
+		t.Errorf("Malformed cookie should be rejected")
+	}
+}
+
+func TestAffinity_CookieHidesBackendAddress(t *testing.T) {
+	affinity := NewAffinity("affinity", []byte("secret"))
+	id := affinity.id("http://server1.com:8081")
+
+	decoded, _ := base64.RawURLEncoding.DecodeString(id)
+	if strings.Contains(id, "server1") || strings.Contains(string(decoded), "server1") {
+		t.Errorf("Expected an opaque identifier, got %s", id)
+	}
+	if id == affinity.id("http://server1.com:8082") {
+		t.Errorf("Expected different identifiers for different backends")
+	}
+}
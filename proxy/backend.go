@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is a single upstream server in the pool
+type Backend struct {
+	URL *url.URL
+	// Weight is the relative share of traffic the backend receives
+	Weight  int
+	alive   atomic.Bool
+	breaker *circuitBreaker
+	// active is the number of in-flight HTTP requests and open WebSocket connections
+	active atomic.Int64
+	// latency is the moving average of the response latency
+	latency ewma
+
+	// currentWeight is the smooth weighted round-robin state, guarded by the RoundRobin mutex
+	currentWeight int
+}
+
+// NewBackend creates a new Backend. Backends are considered alive until a health check says otherwise
+func NewBackend(u *url.URL, weight int) *Backend {
+	if weight <= 0 {
+		weight = 1
+	}
+	b := &Backend{URL: u, Weight: weight}
+	b.alive.Store(true)
+	return b
+}
+
+// Alive reports whether the backend passed its latest health checks
+func (b *Backend) Alive() bool {
+	return b.alive.Load()
+}
+
+// SetAlive marks the backend as up or down
+func (b *Backend) SetAlive(alive bool) {
+	b.alive.Store(alive)
+}
+
+// Available reports whether the backend is alive and not ejected by outlier detection
+func (b *Backend) Available() bool {
+	return b.Alive() && b.breaker.available()
+}
+
+// Active returns the number of in-flight HTTP requests and open WebSocket connections of the backend
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+// begin registers a request proxied to the backend. It must be followed by end once the request
+// or the WebSocket connection is completed
+func (b *Backend) begin() {
+	b.active.Add(1)
+	b.breaker.begin()
+}
+
+// end registers the completion of a request proxied to the backend
+func (b *Backend) end() {
+	b.active.Add(-1)
+}
+
+// observeLatency registers the time the backend took to respond with headers or to accept a WebSocket connection
+func (b *Backend) observeLatency(latency time.Duration) {
+	b.latency.observe(latency, time.Now())
+}
+
+// Latency returns the moving average of the backend response latency
+func (b *Backend) Latency() time.Duration {
+	return time.Duration(b.latency.get(time.Now()))
+}
+
+// report registers the outcome of a request proxied to the backend
+func (b *Backend) report(success bool) {
+	b.breaker.record(success)
+}
+
+// CopyState takes over the state of the backend from the previous configuration, e.g. on a reload, so ejected backends
+// stay ejected and the latency average is kept. The health is only copied when the backend is health checked,
+// otherwise nothing would bring a down backend back
+func (b *Backend) CopyState(previous *Backend, health bool) {
+	if health {
+		b.SetAlive(previous.Alive())
+	}
+	b.breaker.copyState(previous.breaker)
+	b.latency.copyState(&previous.latency)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// BackendTLSConfig configures the TLS connections to the backends of a pool
+type BackendTLSConfig struct {
+	// CAFiles are PEM files with the certificates trusted to sign the backend certificates.
+	// The system roots are used if empty
+	CAFiles []string
+	// ServerName overrides the name the backend certificates are verified against, which is the backend host by default
+	ServerName string
+	// Pins are the base64 SHA-256 hashes of the accepted public keys, e.g. "sha256/AbC...=". A connection is accepted
+	// if the certificate of the backend or one of its verified issuers has a pinned key. Any key is accepted if empty
+	Pins []string
+	// MinVersion is the minimum TLS version, e.g. "1.3". TLS 1.2 if empty
+	MinVersion string
+	// CertFile and KeyFile are the client certificate presented to the backends, e.g. for mTLS
+	CertFile string
+	KeyFile  string
+}
+
+// NewBackendTLSConfig loads the files and creates the TLS configuration of the backend connections
+func NewBackendTLSConfig(cfg BackendTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, MinVersion: tls.VersionTLS12}
+
+	if len(cfg.CAFiles) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, file := range cfg.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", file)
+			}
+		}
+	}
+
+	if cfg.MinVersion != "" {
+		version, err := ParseTLSVersion(cfg.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range cfg.Pins {
+			hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q, expected sha256/<base64 SHA-256 hash>", pin)
+			}
+			pins[string(hash)] = true
+		}
+		tlsConfig.VerifyConnection = verifyPins(pins)
+	}
+	return tlsConfig, nil
+}
+
+// ParseTLSVersion parses a TLS version, e.g. "1.2"
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// verifyPins returns a check accepting the connections with a pinned public key. The issuers only count when
+// the chain is verified, otherwise a backend could present any certificate along with its own
+func verifyPins(pins map[string]bool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("backend didn't present a certificate")
+		}
+		certs := []*x509.Certificate{cs.PeerCertificates[0]}
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		for _, cert := range certs {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[string(hash[:])] {
+				return nil
+			}
+		}
+		return errors.New("backend certificate doesn't match any pinned public key")
+	}
+}
+
+// backendTLSConfig returns the TLS configuration of the connections to the pool backends, or nil if the defaults are used.
+// The configuration of the pool takes precedence over the base one. Skipping the certificate check only applies to
+// the defaults, so the CA bundle, server name or pins of an explicit configuration are never bypassed
+func backendTLSConfig(pool *ServerPool, base *tls.Config, skipCertCheck bool) *tls.Config {
+	if pool != nil && pool.tlsConfig != nil {
+		base = pool.tlsConfig
+	}
+	if base != nil {
+		return base.Clone()
+	}
+	if skipCertCheck {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	return nil
+}
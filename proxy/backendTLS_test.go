@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost, usable by servers and clients, to the directory
+func writeTestCert(t *testing.T, dir string, name string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost", name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func pin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile, serverCert := writeTestCert(t, dir, "backend.internal")
+	clientCertFile, clientKeyFile, clientCert := writeTestCert(t, dir, "proxy")
+	_, _, otherCert := writeTestCert(t, dir, "other")
+
+	// The backend requires the client certificate of the proxy
+	serverKeyPair, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	valid := BackendTLSConfig{
+		CAFiles:    []string{serverCertFile},
+		ServerName: "backend.internal",
+		Pins:       []string{pin(otherCert), pin(serverCert)},
+		MinVersion: "1.2",
+		CertFile:   clientCertFile,
+		KeyFile:    clientKeyFile,
+	}
+	tests := []struct {
+		name   string
+		modify func(cfg *BackendTLSConfig)
+		ok     bool
+	}{
+		{name: "valid", modify: func(cfg *BackendTLSConfig) {}, ok: true},
+		{name: "system roots", modify: func(cfg *BackendTLSConfig) { cfg.CAFiles = nil }},
+		{name: "wrong server name", modify: func(cfg *BackendTLSConfig) { cfg.ServerName = "other" }},
+		{name: "unpinned key", modify: func(cfg *BackendTLSConfig) { cfg.Pins = []string{pin(otherCert)} }},
+		{name: "no client certificate", modify: func(cfg *BackendTLSConfig) { cfg.CertFile, cfg.KeyFile = "", "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			tlsConfig, err := NewBackendTLSConfig(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create the TLS configuration: %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("Expected success %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestBackendTLSConfig_Errors(t *testing.T) {
+	tests := []BackendTLSConfig{
+		{CAFiles: []string{"missing.pem"}},
+		{Pins: []string{"sha256/invalid"}},
+		{MinVersion: "1.4"},
+		{CertFile: "client.crt"},
+	}
+	for _, cfg := range tests {
+		if _, err := NewBackendTLSConfig(cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestServerPool_TLSConfigAppliesToWebSockets(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir, "backend.internal")
+	keyPair, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tlsConfig, err := NewBackendTLSConfig(BackendTLSConfig{CAFiles: []string{certFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendUrl, _ := url.Parse(backend.URL)
+	pool := NewServerPool(nil, testBackends([]*url.URL{backendUrl}))
+	pool.SetTLSConfig(tlsConfig)
+	req := httptest.NewRequest(http.MethodGet, "/websocket", nil)
+	_, conn, _, err := dialBackend(pool, pool.NextServer(req, true), true, nil, req, Options{})
+	if err != nil {
+		t.Fatalf("Expected the backend to be trusted with the CA of the pool: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerPool_TLSConfigIgnoresSkipCertCheck(t *testing.T) {
+	dir := t.TempDir()
+	_, _, otherCert := writeTestCert(t, dir, "other")
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	// The global flag skips the check of the pools without TLS settings
+	pool := NewServerPool(nil, testBackends([]*url.URL{backendUrl}))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: backendTLSConfig(pool, nil, true)}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Expected the certificate check to be skipped: %v", err)
+	}
+	resp.Body.Close()
+
+	// The CA and pins of the pool are enforced regardless of the global flag
+	tlsConfig, err := NewBackendTLSConfig(BackendTLSConfig{Pins: []string{pin(otherCert)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetTLSConfig(tlsConfig)
+	for _, tlsConfig := range []*tls.Config{backendTLSConfig(pool, nil, true), Options{SkipCertCheck: true}.backendTLSConfig(pool)} {
+		if tlsConfig.InsecureSkipVerify {
+			t.Errorf("Expected the certificate check of the pool to be kept")
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		if resp, err := client.Get(backend.URL); err == nil {
+			resp.Body.Close()
+			t.Errorf("Expected the backend not matching the TLS settings of the pool to be rejected")
+		}
+	}
+	if cfg := backendTLSConfig(nil, tlsConfig, true); cfg.InsecureSkipVerify {
+		t.Errorf("Expected the certificate check of the base configuration to be kept")
+	}
+}
+
+func TestBackendTLSConfig_MinVersion(t *testing.T) {
+	tests := map[string]uint16{"": tls.VersionTLS12, "1.0": tls.VersionTLS10, "1.3": tls.VersionTLS13}
+	for minVersion, expected := range tests {
+		tlsConfig, err := NewBackendTLSConfig(BackendTLSConfig{MinVersion: minVersion})
+		if err != nil {
+			t.Fatalf("Failed to create the TLS configuration: %v", err)
+		}
+		if tlsConfig.MinVersion != expected {
+			t.Errorf("Expected minimum version %x for %q, got %x", expected, minVersion, tlsConfig.MinVersion)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer is a load balancing strategy of the ServerPool
+type Balancer interface {
+	// Pick chooses one of the available backends for the request. The request might be nil
+	Pick(backends []*Backend, r *http.Request) *Backend
+}
+
+// poolBalancer is a Balancer that prepares its state for all the backends of the pool, not only the available ones
+type poolBalancer interface {
+	init(backends []*Backend)
+}
+
+// NewBalancer returns the balancing strategy by its name. The hash key is only used by the consistent hash balancer
+func NewBalancer(name string, hashKey string) (Balancer, error) {
+	switch name {
+	case "", "round_robin":
+		return &RoundRobin{}, nil
+	case "least_connections":
+		return &LeastConnections{}, nil
+	case "p2c_ewma":
+		return &PowerOfTwoChoices{}, nil
+	case "consistent_hash":
+		key, err := ParseHashKey(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ConsistentHash{Key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown load balancer %q", name)
+}
+
+// RoundRobin picks backends with the nginx smooth weighted round-robin algorithm.
+// Every backend gains its weight on each pick, the one with the highest current weight wins
+// and loses the total weight. This spreads the picks of heavy backends evenly instead of in bursts
+type RoundRobin struct {
+	mu sync.Mutex
+}
+
+func (rr *RoundRobin) Pick(backends []*Backend, r *http.Request) *Backend {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		b.currentWeight += b.Weight
+		total += b.Weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+// LeastConnections picks the backend with the fewest in-flight HTTP requests and open WebSocket
+// connections relative to its weight. Ties are broken in round-robin fashion
+type LeastConnections struct {
+	current atomic.Uint64
+}
+
+func (lc *LeastConnections) Pick(backends []*Backend, r *http.Request) *Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	start := int(lc.current.Add(1) % uint64(n))
+
+	best := backends[start]
+	for i := 1; i < n; i++ {
+		b := backends[(start+i)%n]
+		// Compare active/weight ratios without dividing
+		if b.Active()*int64(best.Weight) < best.Active()*int64(b.Weight) {
+			best = b
+		}
+	}
+	return best
+}
+
+// PowerOfTwoChoices picks two random backends and routes to the one with the lower score.
+// The score combines the moving average of the backend latency with its in-flight requests,
+// so a slow backend gradually receives less traffic without being ejected
+type PowerOfTwoChoices struct{}
+
+func (p2c *PowerOfTwoChoices) Pick(backends []*Backend, r *http.Request) *Backend {
+	n := len(backends)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	i := rand.IntN(n)
+	j := rand.IntN(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := backends[i], backends[j]
+	if p2cScore(b) < p2cScore(a) {
+		return b
+	}
+	return a
+}
+
+// p2cScore estimates how long a new request would take on the backend. Backends without
+// recent latency samples score close to 0, so they are tried early
+func p2cScore(b *Backend) float64 {
+	return float64(b.Latency()) * float64(b.Active()+1) / float64(b.Weight)
+}
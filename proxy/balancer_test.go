@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLeastConnections_PicksLeastLoaded(t *testing.T) {
+	backends := []*Backend{
+		NewBackend(&url.URL{Host: "server1.com"}, 1),
+		NewBackend(&url.URL{Host: "server2.com"}, 1),
+		NewBackend(&url.URL{Host: "server3.com"}, 1),
+	}
+	pool := NewServerPool(backends, nil)
+	pool.SetBalancer(&LeastConnections{})
+
+	// Long-lived connections are opened to every backend, then the first two are closed
+	for i := 0; i < 3; i++ {
+		pool.NextHttpServer()
+	}
+	backends[0].end()
+	backends[1].end()
+
+	for i := 0; i < 2; i++ {
+		if b := pool.NextHttpServer(); b == backends[2] {
+			t.Fatalf("Expected a backend without connections, got %s", b.URL.Host)
+		}
+	}
+
+	if backends[0].Active() != 1 || backends[1].Active() != 1 || backends[2].Active() != 1 {
+		t.Errorf("Connections are not spread evenly: %d, %d, %d",
+			backends[0].Active(), backends[1].Active(), backends[2].Active())
+	}
+}
+
+func TestLeastConnections_RespectsWeights(t *testing.T) {
+	big := NewBackend(&url.URL{Host: "big.com"}, 3)
+	small := NewBackend(&url.URL{Host: "small.com"}, 1)
+	pool := NewServerPool([]*Backend{big, small}, nil)
+	pool.SetBalancer(&LeastConnections{})
+
+	for i := 0; i < 8; i++ {
+		pool.NextHttpServer()
+	}
+
+	if big.Active() != 6 || small.Active() != 2 {
+		t.Errorf("Expected 6 and 2 connections, got %d and %d", big.Active(), small.Active())
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	if _, err := NewBalancer("least_connections", ""); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := NewBalancer("random", ""); err == nil {
+		t.Errorf("Expected an error for unknown balancer")
+	}
+	if _, err := NewBalancer("consistent_hash", "header"); err == nil {
+		t.Errorf("Expected an error for a header hash key without a name")
+	}
+}
+
+func TestPowerOfTwoChoices_AvoidsSlowBackend(t *testing.T) {
+	fast := NewBackend(&url.URL{Host: "fast.com"}, 1)
+	slow := NewBackend(&url.URL{Host: "slow.com"}, 1)
+	fast.observeLatency(10 * time.Millisecond)
+	slow.observeLatency(500 * time.Millisecond)
+
+	p2c := &PowerOfTwoChoices{}
+	for i := 0; i < 20; i++ {
+		if b := p2c.Pick([]*Backend{fast, slow}, nil); b != fast {
+			t.Fatalf("Expected the fast backend, got %s", b.URL.Host)
+		}
+	}
+
+	// Enough outstanding requests make the fast backend score worse than the slow one
+	for i := 0; i < 100; i++ {
+		fast.begin()
+	}
+	if b := p2c.Pick([]*Backend{fast, slow}, nil); b != slow {
+		t.Errorf("Expected the slow backend, got %s", b.URL.Host)
+	}
+}
+
+func TestEwma_DecaysOverTime(t *testing.T) {
+	var e ewma
+	now := time.Unix(0, 0)
+	e.observe(100*time.Millisecond, now)
+	if e.get(now) != float64(100*time.Millisecond) {
+		t.Fatalf("First sample should be taken as is, got %v", time.Duration(e.get(now)))
+	}
+
+	// A sample long after the previous one almost replaces the average
+	e.observe(10*time.Millisecond, now.Add(time.Minute))
+	if got := time.Duration(e.get(now.Add(time.Minute))); got > 11*time.Millisecond {
+		t.Errorf("Old samples should decay, got %v", got)
+	}
+}
+
+func TestEwma_DecaysWhileIdle(t *testing.T) {
+	var e ewma
+	now := time.Unix(0, 0)
+	e.observe(500*time.Millisecond, now)
+
+	if got := time.Duration(e.get(now.Add(ewmaDecay))); got > 200*time.Millisecond {
+		t.Errorf("Expected the average to decay without samples, got %v", got)
+	}
+	// A backend idle for an hour scores like a fresh one
+	if got := time.Duration(e.get(now.Add(time.Hour))); got > time.Microsecond {
+		t.Errorf("Expected the average to vanish after an hour, got %v", got)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetWindow is the period over which a budget is computed
+const budgetWindow = 10 * time.Second
+
+// minSpendPerWindow lets a few extra requests through even when the traffic is too low for the budget percentage
+const minSpendPerWindow = 3
+
+// budget limits extra requests, such as retries or hedged requests, to a percentage of the traffic,
+// so they can't overload the backends during an incident
+type budget struct {
+	percent float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	spent       int
+}
+
+// count registers a request
+func (b *budget) count() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetWindow(time.Now())
+	b.requests++
+}
+
+// spend reports whether the budget allows one more extra request and spends it.
+// The budget is unlimited if the percentage is 0
+func (b *budget) spend() bool {
+	if b.percent <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetWindow(time.Now())
+	if b.spent >= minSpendPerWindow && float64(b.spent) >= float64(b.requests)*b.percent/100 {
+		return false
+	}
+	b.spent++
+	return true
+}
+
+func (b *budget) resetWindow(now time.Time) {
+	if now.Sub(b.windowStart) >= budgetWindow {
+		b.windowStart = now
+		b.requests, b.spent = 0, 0
+	}
+}
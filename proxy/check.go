@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CheckConfig configures the one-off reachability check of the backends
+type CheckConfig struct {
+	// HTTPPath is requested with GET on every backend, e.g. "/healthz"
+	HTTPPath string
+	// WebSocketPath is dialed with a WebSocket handshake on every backend. The handshake is skipped if empty
+	WebSocketPath string
+	// Timeout of every probe
+	Timeout time.Duration
+	// SkipCertCheck disables verification of the backend certificates. Ignored if TLSConfig is set
+	SkipCertCheck bool
+	// TLSConfig configures the connections to the HTTPS backends, see NewBackendTLSConfig. The defaults are used if nil
+	TLSConfig *tls.Config
+}
+
+// CheckResult is the outcome of checking a single backend
+type CheckResult struct {
+	URL *url.URL
+	// HTTPStatus is the status of the GET request, 0 if it failed
+	HTTPStatus  int
+	HTTPLatency time.Duration
+	HTTPErr     error
+	// WebSocketLatency is the duration of the handshake, 0 if it was skipped
+	WebSocketLatency time.Duration
+	WebSocketErr     error
+	// Certificate is the leaf certificate presented by an HTTPS backend
+	Certificate *x509.Certificate
+}
+
+// OK reports whether the backend answered the GET request without a server error and accepted the WebSocket handshake
+func (r CheckResult) OK() bool {
+	return r.HTTPErr == nil && r.HTTPStatus < http.StatusInternalServerError && r.WebSocketErr == nil
+}
+
+// CheckBackend probes the backend with a GET request and a WebSocket handshake
+func CheckBackend(ctx context.Context, u *url.URL, cfg CheckConfig) CheckResult {
+	result := CheckResult{URL: u}
+	tlsConfig := backendTLSConfig(nil, cfg.TLSConfig, cfg.SkipCertCheck)
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   cfg.Timeout,
+		// Redirects are an answer of the backend, not something to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath(cfg.HTTPPath).String(), nil)
+	if err != nil {
+		result.HTTPErr = err
+		return result
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.HTTPLatency = time.Since(start)
+	if err != nil {
+		result.HTTPErr = err
+	} else {
+		resp.Body.Close()
+		result.HTTPStatus = resp.StatusCode
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			result.Certificate = resp.TLS.PeerCertificates[0]
+		}
+	}
+
+	if cfg.WebSocketPath == "" {
+		return result
+	}
+	wsURL := *u.JoinPath(cfg.WebSocketPath)
+	wsURL.Scheme = "ws"
+	if u.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	}
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: cfg.Timeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	start = time.Now()
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), nil)
+	result.WebSocketLatency = time.Since(start)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (status %d)", err, resp.StatusCode)
+			resp.Body.Close()
+		}
+		result.WebSocketErr = err
+		return result
+	}
+	conn.Close()
+	return result
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckBackend(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	result := CheckBackend(context.Background(), u, CheckConfig{HTTPPath: "/health", WebSocketPath: "/ws", Timeout: time.Second, SkipCertCheck: true})
+	if !result.OK() {
+		t.Fatalf("Expected the backend to pass the check, got %+v", result)
+	}
+	if result.HTTPStatus != http.StatusNoContent || result.Certificate == nil {
+		t.Errorf("Expected the status and the certificate of the backend, got %+v", result)
+	}
+
+	// The certificate of the test server isn't trusted
+	if result := CheckBackend(context.Background(), u, CheckConfig{Timeout: time.Second}); result.OK() {
+		t.Errorf("Expected the certificate check to fail")
+	}
+}
+
+func TestCheckBackend_WebSocketRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	result := CheckBackend(context.Background(), u, CheckConfig{WebSocketPath: "/ws", Timeout: time.Second})
+	if result.HTTPErr != nil || result.WebSocketErr == nil || result.OK() {
+		t.Errorf("Expected only the WebSocket handshake to fail, got %+v", result)
+	}
+}
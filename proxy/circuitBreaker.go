@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// OutlierDetectionConfig configures passive outlier detection based on the real traffic.
+// A backend is ejected from the pool for the cool-down period after too many consecutive failures
+// or when its error rate is too high. After the cool-down a few trial requests are let through
+// before the backend is fully reinstated
+type OutlierDetectionConfig struct {
+	// Number of consecutive failures that ejects the backend. Disabled if 0
+	ConsecutiveFailures int
+	// Failure ratio (0..1] within the window that ejects the backend. Disabled if 0
+	ErrorRateThreshold float64
+	// Minimal number of requests within the window before the error rate is taken into account
+	MinRequests int
+	Window      time.Duration
+	Cooldown    time.Duration
+	// Number of successful trial requests needed to close the circuit again
+	HalfOpenRequests int
+}
+
+// Enabled reports whether any of the ejection conditions is configured
+func (c OutlierDetectionConfig) Enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.ErrorRateThreshold > 0
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker tracks the outcome of the requests sent to a single backend.
+// A nil circuitBreaker never ejects the backend
+type circuitBreaker struct {
+	cfg  OutlierDetectionConfig
+	name string
+
+	mu          sync.Mutex
+	state       breakerState
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	changedAt   time.Time
+	trials      int
+	successes   int
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(name string, cfg OutlierDetectionConfig) *circuitBreaker {
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &circuitBreaker{cfg: cfg, name: name, now: time.Now}
+}
+
+// available reports whether a request may be sent to the backend
+func (cb *circuitBreaker) available() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.admit(cb.now())
+}
+
+// begin registers a request sent to the backend, which counts as a trial when the circuit is half-open
+func (cb *circuitBreaker) begin() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.admit(cb.now()) && cb.state == breakerHalfOpen {
+		cb.trials++
+	}
+}
+
+func (cb *circuitBreaker) admit(now time.Time) bool {
+	switch cb.state {
+	case breakerOpen:
+		if now.Sub(cb.changedAt) < cb.cfg.Cooldown {
+			return false
+		}
+		log.Printf("Backend %s is half-open, sending trial requests", cb.name)
+		cb.setState(breakerHalfOpen, now)
+	case breakerHalfOpen:
+		// Trial requests whose outcome is never reported must not keep the backend ejected forever
+		if cb.trials >= cb.cfg.HalfOpenRequests && now.Sub(cb.changedAt) >= cb.cfg.Cooldown {
+			cb.setState(breakerHalfOpen, now)
+		}
+	}
+
+	return cb.state != breakerHalfOpen || cb.trials < cb.cfg.HalfOpenRequests
+}
+
+// record registers the outcome of a request sent to the backend
+func (cb *circuitBreaker) record(success bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := cb.now()
+
+	switch cb.state {
+	case breakerOpen:
+		// Late results of the requests sent before the ejection are ignored
+		return
+	case breakerHalfOpen:
+		if !success {
+			log.Printf("Trial request to backend %s failed, ejecting it again", cb.name)
+			cb.setState(breakerOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			log.Printf("Backend %s is reinstated", cb.name)
+			cb.setState(breakerClosed, now)
+		}
+		return
+	}
+
+	if now.Sub(cb.windowStart) >= cb.cfg.Window {
+		cb.windowStart = now
+		cb.requests, cb.failures = 0, 0
+	}
+	cb.requests++
+	if success {
+		cb.consecutive = 0
+		return
+	}
+	cb.failures++
+	cb.consecutive++
+
+	if cb.cfg.ConsecutiveFailures > 0 && cb.consecutive >= cb.cfg.ConsecutiveFailures {
+		log.Printf("Backend %s is ejected after %d consecutive failures", cb.name, cb.consecutive)
+		cb.setState(breakerOpen, now)
+		return
+	}
+	if cb.cfg.ErrorRateThreshold > 0 && cb.requests >= cb.cfg.MinRequests &&
+		float64(cb.failures)/float64(cb.requests) >= cb.cfg.ErrorRateThreshold {
+		log.Printf("Backend %s is ejected with error rate %d/%d", cb.name, cb.failures, cb.requests)
+		cb.setState(breakerOpen, now)
+	}
+}
+
+// copyState takes over the state of the other breaker, which tracked the same backend with a previous configuration
+func (cb *circuitBreaker) copyState(other *circuitBreaker) {
+	if cb == nil || other == nil {
+		return
+	}
+	other.mu.Lock()
+	state, changedAt, consecutive := other.state, other.changedAt, other.consecutive
+	windowStart, requests, failures := other.windowStart, other.requests, other.failures
+	other.mu.Unlock()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.state, cb.changedAt, cb.consecutive = state, changedAt, consecutive
+	cb.windowStart, cb.requests, cb.failures = windowStart, requests, failures
+	// The trials in flight are reported to the previous breaker
+	cb.trials, cb.successes = 0, 0
+}
+
+func (cb *circuitBreaker) setState(state breakerState, now time.Time) {
+	cb.state = state
+	cb.changedAt = now
+	cb.consecutive = 0
+	cb.requests, cb.failures = 0, 0
+	cb.windowStart = now
+	cb.trials, cb.successes = 0, 0
+}
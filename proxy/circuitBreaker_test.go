@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(cfg OutlierDetectionConfig) (*circuitBreaker, *time.Time) {
+	now := time.Unix(0, 0)
+	cb := newCircuitBreaker("test", cfg)
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+func TestCircuitBreaker_ConsecutiveFailures(t *testing.T) {
+	cb, now := newTestBreaker(OutlierDetectionConfig{
+		ConsecutiveFailures: 3,
+		Window:              time.Minute,
+		Cooldown:            10 * time.Second,
+		HalfOpenRequests:    2,
+	})
+
+	cb.record(false)
+	cb.record(false)
+	cb.record(true)
+	cb.record(false)
+	cb.record(false)
+	if !cb.available() {
+		t.Fatalf("Breaker should stay closed when failures are not consecutive")
+	}
+
+	cb.record(false)
+	if cb.available() {
+		t.Fatalf("Breaker should open after 3 consecutive failures")
+	}
+
+	*now = now.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		if !cb.available() {
+			t.Fatalf("Breaker should let trial requests through after the cool-down")
+		}
+		cb.begin()
+	}
+	if cb.available() {
+		t.Fatalf("Breaker should not let more than 2 trial requests through")
+	}
+
+	cb.record(true)
+	cb.record(true)
+	if cb.state != breakerClosed {
+		t.Fatalf("Breaker should close after successful trial requests")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenFailureReopens(t *testing.T) {
+	cb, now := newTestBreaker(OutlierDetectionConfig{
+		ConsecutiveFailures: 1,
+		Window:              time.Minute,
+		Cooldown:            10 * time.Second,
+	})
+
+	cb.record(false)
+	*now = now.Add(10 * time.Second)
+	if !cb.available() {
+		t.Fatalf("Breaker should let a trial request through after the cool-down")
+	}
+	cb.begin()
+	cb.record(false)
+	if cb.available() {
+		t.Fatalf("Breaker should open again after a failed trial request")
+	}
+}
+
+func TestCircuitBreaker_ErrorRate(t *testing.T) {
+	cb, now := newTestBreaker(OutlierDetectionConfig{
+		ErrorRateThreshold: 0.5,
+		MinRequests:        4,
+		Window:             time.Minute,
+		Cooldown:           10 * time.Second,
+	})
+
+	cb.record(false)
+	cb.record(true)
+	cb.record(false)
+	if !cb.available() {
+		t.Fatalf("Breaker should not open before the minimal number of requests")
+	}
+
+	// Window is reset, so older failures are forgotten
+	*now = now.Add(time.Minute)
+	cb.record(true)
+	cb.record(true)
+	cb.record(false)
+	cb.record(true)
+	if !cb.available() {
+		t.Fatalf("Breaker should stay closed under the error rate threshold")
+	}
+	cb.record(false)
+	cb.record(false)
+	if cb.available() {
+		t.Fatalf("Breaker should open when the error rate reaches the threshold")
+	}
+}
+
+func TestProxyHandler_EjectsFailingBackend(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	failingUrl, _ := url.Parse(failing.URL)
+	healthyUrl, _ := url.Parse(healthy.URL)
+	pool := NewServerPool(testBackends([]*url.URL{failingUrl, healthyUrl}), nil)
+	pool.EnableOutlierDetection(OutlierDetectionConfig{
+		ConsecutiveFailures: 2,
+		Window:              time.Minute,
+		Cooldown:            time.Minute,
+	})
+	handler := ProxyHandler(pool, false, false, Options{})
+
+	for i := 0; i < 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status code %d after the ejection, got %d", http.StatusOK, rec.Code)
+		}
+	}
+}
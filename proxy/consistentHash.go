@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// virtualNodes is the number of points a backend of weight 1 has on the hash ring
+const virtualNodes = 160
+
+// HashKey describes which part of the request is hashed to choose the backend
+type HashKey struct {
+	// Source is one of "ip", "header", "cookie", "query" or "path"
+	Source string
+	// Name of the header, cookie or query parameter
+	Name string
+}
+
+// ParseHashKey parses the hash key description, e.g. "ip", "path", "header:X-User-Id",
+// "cookie:session" or "query:user"
+func ParseHashKey(spec string) (HashKey, error) {
+	source, name, _ := strings.Cut(spec, ":")
+	switch source {
+	case "", "ip":
+		return HashKey{Source: "ip"}, nil
+	case "path":
+		return HashKey{Source: source}, nil
+	case "header", "cookie", "query":
+		if name == "" {
+			return HashKey{}, fmt.Errorf("hash key %q requires a name, e.g. %s:name", spec, source)
+		}
+		return HashKey{Source: source, Name: name}, nil
+	}
+	return HashKey{}, fmt.Errorf("unknown hash key source %q", source)
+}
+
+// value extracts the key from the request. Requests without the key are hashed by the client IP
+func (k HashKey) value(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	var v string
+	switch k.Source {
+	case "header":
+		v = r.Header.Get(k.Name)
+	case "cookie":
+		if c, err := r.Cookie(k.Name); err == nil {
+			v = c.Value
+		}
+	case "query":
+		v = r.URL.Query().Get(k.Name)
+	case "path":
+		v = r.URL.Path
+	}
+	if v != "" {
+		return v
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// ConsistentHash routes requests with the same key to the same backend using a hash ring with
+// virtual nodes. The ring holds every backend of the pool, the ones that are not available are skipped
+// while walking it, so only the keys of an unavailable backend are remapped
+type ConsistentHash struct {
+	Key HashKey
+
+	mu       sync.RWMutex
+	backends []*Backend
+	ring     []ringNode
+}
+
+type ringNode struct {
+	hash    uint64
+	backend *Backend
+}
+
+func (ch *ConsistentHash) Pick(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	ring := ch.ringFor(backends)
+
+	h := hashString(ch.Key.value(r))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for i := 0; i < len(ring); i++ {
+		node := ring[(start+i)%len(ring)]
+		if slices.Contains(backends, node.backend) {
+			return node.backend
+		}
+	}
+	return nil
+}
+
+// init builds the ring for all the backends of the pool
+func (ch *ConsistentHash) init(backends []*Backend) {
+	ch.ringFor(backends)
+}
+
+// ringFor returns a ring with all the given backends, rebuilding it only when a backend is missing from the ring
+func (ch *ConsistentHash) ringFor(backends []*Backend) []ringNode {
+	ch.mu.RLock()
+	ring, known := ch.ring, ch.backends
+	ch.mu.RUnlock()
+	missing := slices.ContainsFunc(backends, func(b *Backend) bool { return !slices.Contains(known, b) })
+	if !missing {
+		return ring
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for _, b := range backends {
+		if !slices.Contains(ch.backends, b) {
+			ch.backends = append(ch.backends, b)
+		}
+	}
+	ring = make([]ringNode, 0, len(ch.backends)*virtualNodes)
+	for _, b := range ch.backends {
+		for i := 0; i < virtualNodes*b.Weight; i++ {
+			ring = append(ring, ringNode{hashString(b.URL.String() + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	ch.ring = ring
+	return ring
+}
+
+// hashString is FNV-1a followed by the splitmix64 finalizer, which spreads similar strings
+// such as virtual node names evenly over the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
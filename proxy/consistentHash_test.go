@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestConsistentHash_SameKeySameBackend(t *testing.T) {
+	pool := NewServerPool([]*Backend{
+		NewBackend(&url.URL{Host: "server1.com"}, 1),
+		NewBackend(&url.URL{Host: "server2.com"}, 1),
+		NewBackend(&url.URL{Host: "server3.com"}, 1),
+	}, nil)
+	pool.SetBalancer(&ConsistentHash{Key: HashKey{Source: "header", Name: "X-User"}})
+
+	hosts := map[string]struct{}{}
+	for i := 0; i < 30; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user%d", i))
+
+		first := pool.NextServer(req, false)
+		second := pool.NextServer(req, false)
+		if first != second {
+			t.Fatalf("Requests of user%d were routed to %s and %s", i, first.URL.Host, second.URL.Host)
+		}
+		hosts[first.URL.Host] = struct{}{}
+	}
+
+	if len(hosts) != 3 {
+		t.Errorf("Keys should be spread across all backends, got %v", hosts)
+	}
+}
+
+func TestConsistentHash_MinimalRemapping(t *testing.T) {
+	backends := []*Backend{
+		NewBackend(&url.URL{Host: "server1.com"}, 1),
+		NewBackend(&url.URL{Host: "server2.com"}, 1),
+		NewBackend(&url.URL{Host: "server3.com"}, 1),
+		NewBackend(&url.URL{Host: "server4.com"}, 1),
+	}
+	ch := &ConsistentHash{Key: HashKey{Source: "path"}}
+
+	const keys = 1000
+	before := make([]*Backend, keys)
+	for i := range before {
+		before[i] = ch.Pick(backends, httptest.NewRequest("GET", fmt.Sprintf("/item/%d", i), nil))
+	}
+
+	// The last backend goes down
+	remapped := 0
+	for i := range before {
+		after := ch.Pick(backends[:3], httptest.NewRequest("GET", fmt.Sprintf("/item/%d", i), nil))
+		if before[i] != backends[3] && after != before[i] {
+			t.Fatalf("Key %d moved from a backend that is still available", i)
+		}
+		if after != before[i] {
+			remapped++
+		}
+	}
+
+	if remapped == 0 || remapped > keys/2 {
+		t.Errorf("Expected about a quarter of keys to be remapped, got %d of %d", remapped, keys)
+	}
+}
+
+func TestHashKey_Value(t *testing.T) {
+	req := httptest.NewRequest("GET", "/path?user=bob", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-User", "alice")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	tests := map[string]string{
+		"ip":             "10.0.0.1",
+		"path":           "/path",
+		"header:X-User":  "alice",
+		"cookie:session": "abc",
+		"query:user":     "bob",
+		"query:missing":  "10.0.0.1",
+	}
+	for spec, expected := range tests {
+		key, err := ParseHashKey(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", spec, err)
+		}
+		if v := key.value(req); v != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, spec, v)
+		}
+	}
+}
+
+func TestConsistentHash_RingBuiltOnce(t *testing.T) {
+	httpBackends := []*Backend{NewBackend(&url.URL{Host: "server1.com"}, 1), NewBackend(&url.URL{Host: "server2.com"}, 1)}
+	httpsBackends := []*Backend{NewBackend(&url.URL{Scheme: "https", Host: "server1.com"}, 1)}
+	pool := NewServerPool(httpBackends, httpsBackends)
+	ch := &ConsistentHash{Key: HashKey{Source: "path"}}
+	pool.SetBalancer(ch)
+	ring := &ch.ring[0]
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/item/%d", i), nil)
+		if b := pool.NextServer(req, i%2 == 0); b == nil {
+			t.Fatalf("Expected a backend for request %d", i)
+		}
+		// Retries skip the backends already tried
+		if b := pool.NextServerExcept(req, false, httpBackends[:1]); b != httpBackends[1] {
+			t.Fatalf("Expected the other backend, got %v", b)
+		}
+	}
+
+	if &ch.ring[0] != ring || len(ch.ring) != 3*virtualNodes {
+		t.Errorf("Expected the ring of all the pool backends to be built once")
+	}
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDifferences limits the number of differences reported for a pair of responses
+const maxDifferences = 20
+
+// DiffConfig configures the comparison of the primary and shadow responses
+type DiffConfig struct {
+	// Headers compared in addition to the status code
+	Headers []string
+	// IgnoreFields are the JSON fields left out of the comparison at any depth, e.g. "timestamp" or "request_id"
+	IgnoreFields []string
+	// MaxBodySize is the largest response body compared. Larger bodies are not compared
+	MaxBodySize int64
+}
+
+// ResponseDiff compares the responses of the primary and shadow pools of a route and records the mismatches.
+// JSON bodies are compared field by field, other bodies by their hash
+type ResponseDiff struct {
+	route  string
+	cfg    DiffConfig
+	ignore map[string]bool
+	log    *DiffLog
+}
+
+// NewResponseDiff creates a new ResponseDiff recording the mismatches of the route to the log
+func NewResponseDiff(route string, cfg DiffConfig, log *DiffLog) *ResponseDiff {
+	ignore := make(map[string]bool, len(cfg.IgnoreFields))
+	for _, field := range cfg.IgnoreFields {
+		ignore[field] = true
+	}
+	return &ResponseDiff{route: route, cfg: cfg, ignore: ignore, log: log}
+}
+
+// DiffLog writes mismatch records to a file, one JSON object per line
+type DiffLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenDiffLog opens the file the mismatches are appended to
+func OpenDiffLog(path string) (*DiffLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &DiffLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Close closes the file
+func (l *DiffLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *DiffLog) write(record mismatchRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(record)
+}
+
+// capturedResponse is a response of either pool as far as it's compared
+type capturedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	// truncated reports whether the body was larger than the size cap
+	truncated bool
+}
+
+type mismatchRecord struct {
+	Time        time.Time       `json:"time"`
+	Route       string          `json:"route"`
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	Primary     responseSummary `json:"primary"`
+	Shadow      responseSummary `json:"shadow"`
+	Differences []string        `json:"differences"`
+}
+
+type responseSummary struct {
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	BodyHash string            `json:"body_hash,omitempty"`
+}
+
+// compare compares the responses and records them if they don't match. It reports whether they match
+func (d *ResponseDiff) compare(method string, target string, primary, shadow *capturedResponse) bool {
+	var diffs []string
+	if primary.status != shadow.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.status, shadow.status))
+	}
+	for _, hdr := range d.cfg.Headers {
+		if p, s := primary.header.Get(hdr), shadow.header.Get(hdr); p != s {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", hdr, p, s))
+		}
+	}
+	if !primary.truncated && !shadow.truncated {
+		diffs = append(diffs, d.compareBodies(primary.body, shadow.body)...)
+	}
+	if len(diffs) == 0 {
+		return true
+	}
+
+	record := mismatchRecord{
+		Time:        time.Now().UTC(),
+		Route:       d.route,
+		Method:      method,
+		URL:         target,
+		Primary:     d.summary(primary),
+		Shadow:      d.summary(shadow),
+		Differences: diffs,
+	}
+	if err := d.log.write(record); err != nil {
+		log.Printf("Couldn't record response mismatch of route %s: %v", d.route, err)
+	}
+	return false
+}
+
+// compareBodies compares JSON bodies field by field without the ignored fields and other bodies by their hash
+func (d *ResponseDiff) compareBodies(primary, shadow []byte) []string {
+	var p, s any
+	if json.Unmarshal(primary, &p) == nil && json.Unmarshal(shadow, &s) == nil {
+		var diffs []string
+		d.compareJSON("$", p, s, &diffs)
+		return diffs
+	}
+	if !bytes.Equal(primary, shadow) {
+		return []string{"body: hash " + bodyHash(primary) + " != " + bodyHash(shadow)}
+	}
+	return nil
+}
+
+// compareJSON appends the paths of the values differing between the JSON documents
+func (d *ResponseDiff) compareJSON(path string, p, s any, diffs *[]string) {
+	if len(*diffs) >= maxDifferences {
+		return
+	}
+	switch p := p.(type) {
+	case map[string]any:
+		s, ok := s.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool, len(p)+len(s))
+		for key := range p {
+			keys[key] = true
+		}
+		for key := range s {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			if !d.ignore[key] {
+				sorted = append(sorted, key)
+			}
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			d.compareJSON(path+"."+key, p[key], s[key], diffs)
+		}
+		return
+	case []any:
+		s, ok := s.([]any)
+		if !ok || len(p) != len(s) {
+			break
+		}
+		for i := range p {
+			d.compareJSON(fmt.Sprintf("%s[%d]", path, i), p[i], s[i], diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(p, s) {
+		*diffs = append(*diffs, fmt.Sprintf("body %s: %s != %s", path, jsonString(p), jsonString(s)))
+	}
+}
+
+func (d *ResponseDiff) summary(resp *capturedResponse) responseSummary {
+	summary := responseSummary{Status: resp.status}
+	if !resp.truncated {
+		summary.BodyHash = bodyHash(resp.body)
+	}
+	for _, hdr := range d.cfg.Headers {
+		if val := resp.header.Get(hdr); val != "" {
+			if summary.Headers == nil {
+				summary.Headers = make(map[string]string)
+			}
+			summary.Headers[hdr] = val
+		}
+	}
+	return summary
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func jsonString(v any) string {
+	if v == nil {
+		return "missing"
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// responseCapture passes the primary response to the client while keeping a copy of it for the comparison
+type responseCapture struct {
+	http.ResponseWriter
+	resp  capturedResponse
+	limit int64
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	// Informational responses are followed by the final one
+	if c.resp.status == 0 && code >= http.StatusOK {
+		c.resp.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.resp.status == 0 {
+		c.resp.status = http.StatusOK
+	}
+	if !c.resp.truncated {
+		if int64(len(c.resp.body)+len(b)) > c.limit {
+			c.resp.truncated = true
+			c.resp.body = nil
+		} else {
+			c.resp.body = append(c.resp.body, b...)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streamed responses
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// captured returns the primary response once it has been written
+func (c *responseCapture) captured() *capturedResponse {
+	resp := c.resp
+	resp.header = c.Header().Clone()
+	return &resp
+}
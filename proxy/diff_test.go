@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseDiff_RecordsMismatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mismatches.jsonl")
+	diffLog, err := OpenDiffLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open diff log: %v", err)
+	}
+	defer diffLog.Close()
+	diff := NewResponseDiff("api", DiffConfig{
+		Headers:      []string{"Content-Type"},
+		IgnoreFields: []string{"timestamp"},
+		MaxBodySize:  1024,
+	}, diffLog)
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	primary := &capturedResponse{status: 200, header: header, body: []byte(`{"id": 1, "items": [1, 2], "timestamp": 100}`)}
+	same := &capturedResponse{status: 200, header: header, body: []byte(`{"timestamp": 200, "items": [1, 2], "id": 1}`)}
+	if !diff.compare("GET", "/orders/1", primary, same) {
+		t.Errorf("Responses differing only by field order and ignored fields should match")
+	}
+
+	different := &capturedResponse{status: 200, header: header, body: []byte(`{"id": 1, "items": [1, 3], "timestamp": 100}`)}
+	if diff.compare("GET", "/orders/1", primary, different) {
+		t.Errorf("Responses with different items should not match")
+	}
+	text := &capturedResponse{status: 500, header: http.Header{}, body: []byte("error")}
+	if diff.compare("GET", "/orders/2", primary, text) {
+		t.Errorf("Responses with different statuses should not match")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read diff log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 mismatch records, got %d: %s", len(lines), data)
+	}
+	var record mismatchRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Invalid mismatch record: %v", err)
+	}
+	if record.Route != "api" || len(record.Differences) != 1 || !strings.HasPrefix(record.Differences[0], "body $.items[1]") {
+		t.Errorf("Unexpected mismatch record %+v", record)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatalf("Invalid mismatch record: %v", err)
+	}
+	if len(record.Differences) != 3 || record.Shadow.Status != 500 {
+		t.Errorf("Expected status, header and body differences, got %+v", record)
+	}
+}
+
+func TestMirror_ComparesShadowResponses(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": 1}`))
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": 2}`))
+	}))
+	defer shadow.Close()
+
+	primaryURL, _ := url.Parse(primary.URL)
+	shadowURL, _ := url.Parse(shadow.URL)
+	mirror := NewMirror(NewServerPool(testBackends([]*url.URL{shadowURL}), nil), MirrorConfig{
+		Percent:       100,
+		Timeout:       time.Second,
+		MaxConcurrent: 10,
+	})
+	diffLog, err := OpenDiffLog(filepath.Join(t.TempDir(), "mismatches.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open diff log: %v", err)
+	}
+	defer diffLog.Close()
+	mirror.Diff = NewResponseDiff("api", DiffConfig{MaxBodySize: 1024}, diffLog)
+
+	route, _ := NewRoute("api", "/", NewServerPool(testBackends([]*url.URL{primaryURL}), nil))
+	route.Mirror = mirror
+	router := NewRouter(nil)
+	router.Add(route)
+	handler := RoutingHandler(NewVirtualHosts(router), false, Options{})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if rec.Body.String() != `{"version": 1}` {
+		t.Fatalf("Expected the primary response, got %q", rec.Body.String())
+	}
+	waitFor(t, func() bool { return mirror.Stats().Mismatches == 1 })
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ewmaDecay is the time constant of the latency moving average. Older samples lose their weight
+// exponentially, so the average adapts within a few seconds when a backend becomes slow
+const ewmaDecay = 10 * time.Second
+
+// ewma is a time-decayed exponentially weighted moving average of response latency
+type ewma struct {
+	mu     sync.Mutex
+	value  float64
+	last   time.Time
+	sample bool
+}
+
+// observe adds a latency sample taken at the given time
+func (e *ewma) observe(latency time.Duration, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.sample {
+		e.value = float64(latency)
+		e.last = now
+		e.sample = true
+		return
+	}
+
+	w := math.Exp(-float64(now.Sub(e.last)) / float64(ewmaDecay))
+	e.value = e.value*w + float64(latency)*(1-w)
+	e.last = now
+}
+
+// get returns the average at the given time, which is 0 until the first sample is observed. The average keeps
+// decaying while no samples are observed, so a backend that was slow once is tried again after a while
+func (e *ewma) get(now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.sample || !now.After(e.last) {
+		return e.value
+	}
+	return e.value * math.Exp(-float64(now.Sub(e.last))/float64(ewmaDecay))
+}
+
+// copyState copies the samples of the other average
+func (e *ewma) copyState(other *ewma) {
+	other.mu.Lock()
+	value, last, sample := other.value, other.last, other.sample
+	other.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.value, e.last, e.sample = value, last, sample
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// HealthCheckConfig configures active health checking of the pool backends
+type HealthCheckConfig struct {
+	// Path is requested on every backend, e.g. "/healthz"
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Number of consecutive successful probes needed to mark a down backend as up
+	HealthyThreshold int
+	// Number of consecutive failed probes needed to mark an up backend as down
+	UnhealthyThreshold int
+	// Status codes treated as healthy. Any 2xx status is healthy if empty
+	ExpectedStatuses []int
+	SkipCertCheck    bool
+}
+
+// StartHealthChecks starts a background health checker for every backend of the pool.
+// Checkers are stopped when the context is cancelled
+func (p *ServerPool) StartHealthChecks(ctx context.Context, cfg HealthCheckConfig) {
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		// Redirects are reported as is, so they can be listed in the expected statuses
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if tlsConfig := backendTLSConfig(p, nil, cfg.SkipCertCheck); tlsConfig != nil {
+		client.Transport = &http.Transport{
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	for _, b := range p.Backends() {
+		go runHealthCheck(ctx, client, b, cfg)
+	}
+}
+
+// runHealthCheck probes a single backend until the context is cancelled
+func runHealthCheck(ctx context.Context, client *http.Client, b *Backend, cfg HealthCheckConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := probe(ctx, client, b, cfg); err != nil {
+			successes = 0
+			failures++
+			if b.Alive() && failures >= cfg.UnhealthyThreshold {
+				log.Printf("Backend %s is down: %v", b.URL, err)
+				b.SetAlive(false)
+			}
+		} else {
+			failures = 0
+			successes++
+			if !b.Alive() && successes >= cfg.HealthyThreshold {
+				log.Printf("Backend %s is up", b.URL)
+				b.SetAlive(true)
+			}
+		}
+	}
+}
+
+// probe sends a single health check request to the backend
+func probe(ctx context.Context, client *http.Client, b *Backend, cfg HealthCheckConfig) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.JoinPath(cfg.Path).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if !expectedStatus(resp.StatusCode, cfg.ExpectedStatuses) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func expectedStatus(code int, expected []int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 300
+	}
+	return slices.Contains(expected, code)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition was not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck_MarksBackendDownAndUp(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("Unexpected health check path %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	pool := NewServerPool(testBackends([]*url.URL{u}), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.StartHealthChecks(ctx, testHealthCheckConfig())
+
+	waitFor(t, func() bool { return pool.NextHttpServer() == nil })
+
+	status.Store(http.StatusOK)
+	waitFor(t, func() bool { return pool.NextHttpServer() != nil })
+}
+
+func TestServerPool_SkipsDeadBackends(t *testing.T) {
+	httpUrls := []*url.URL{
+		{Host: "server1.com"},
+		{Host: "server2.com"},
+	}
+	pool := NewServerPool(testBackends(httpUrls), nil)
+	pool.httpServers[0].SetAlive(false)
+
+	for i := 0; i < 4; i++ {
+		if server := pool.NextHttpServer(); server.URL.Host != "server2.com" {
+			t.Errorf("Expected server2.com, got %s", server.URL.Host)
+		}
+	}
+
+	pool.httpServers[1].SetAlive(false)
+	if server := pool.NextHttpServer(); server != nil {
+		t.Errorf("Expected no server, got %s", server.URL.Host)
+	}
+}
+
+func TestExpectedStatus(t *testing.T) {
+	if !expectedStatus(204, nil) || expectedStatus(301, nil) {
+		t.Errorf("Only 2xx statuses should be healthy by default")
+	}
+	if !expectedStatus(301, []int{200, 301}) || expectedStatus(204, []int{200, 301}) {
+		t.Errorf("Only configured statuses should be healthy")
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of recent latencies the hedging delay percentile is computed from
+const latencySamples = 1000
+
+// minLatencySamples is the number of samples needed before the percentile is used instead of the fixed delay
+const minLatencySamples = 20
+
+// HedgeConfig configures hedged requests. If the backend has not returned the response headers
+// within the delay, a duplicate request is sent to another backend and whichever answers first is used
+type HedgeConfig struct {
+	// Delay before the hedged request is sent
+	Delay time.Duration
+	// Percentile (0..100) of the observed latency used as the delay instead of the fixed one. Disabled if 0
+	Percentile float64
+	// BudgetPercent limits hedged requests to the percentage of the requests. Unlimited if 0
+	BudgetPercent float64
+}
+
+// HedgePolicy decides when read-only requests are hedged
+type HedgePolicy struct {
+	cfg    HedgeConfig
+	budget *budget
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	cached    time.Duration
+	stale     int
+}
+
+// NewHedgePolicy creates a new HedgePolicy
+func NewHedgePolicy(cfg HedgeConfig) *HedgePolicy {
+	return &HedgePolicy{cfg: cfg, budget: &budget{percent: cfg.BudgetPercent}}
+}
+
+// eligible reports whether the request may be hedged. Only read-only requests without a body are hedged
+func (p *HedgePolicy) eligible(r *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && (r.Body == nil || r.Body == http.NoBody)
+}
+
+// observe registers the latency of a hedge-eligible request
+func (p *HedgePolicy) observe(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latencies) < latencySamples {
+		p.latencies = append(p.latencies, latency)
+	} else {
+		p.latencies[p.next] = latency
+		p.next = (p.next + 1) % latencySamples
+	}
+	p.stale++
+}
+
+// delay returns the time to wait before sending the hedged request
+func (p *HedgePolicy) delay() time.Duration {
+	if p.cfg.Percentile <= 0 {
+		return p.cfg.Delay
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latencies) < minLatencySamples {
+		return p.cfg.Delay
+	}
+	// Sorting the samples on every request is too expensive, so the percentile is refreshed periodically
+	if p.cached == 0 || p.stale >= minLatencySamples {
+		sorted := slices.Clone(p.latencies)
+		slices.Sort(sorted)
+		p.cached = sorted[int(float64(len(sorted)-1)*p.cfg.Percentile/100)]
+		p.stale = 0
+	}
+	return p.cached
+}
+
+// hedgedTransport sends the request to the primary backend and, if it's slow to respond,
+// a duplicate request to another backend of the pool
+type hedgedTransport struct {
+	// transport returns the transport of the backend the request is sent to
+	transport func(*Backend) http.RoundTripper
+	policy    *HedgePolicy
+	pool      *ServerPool
+	https     bool
+	primary   *Backend
+	// inbound is the request received by the proxy, the hedged request is built from it like the primary one
+	inbound *http.Request
+
+	// hedgeWinner is set when the response comes from the hedged backend
+	hedgeWinner *Backend
+	// primaryReported is set when the outcome of the primary request has already been reported to its backend
+	primaryReported bool
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	backend *Backend
+	cancel  context.CancelFunc
+}
+
+func (t *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.policy.budget.count()
+	start := time.Now()
+	results := make(chan hedgeResult, 2)
+	// Requests are keyed by their backend, the primary one is nil
+	cancels := map[*Backend]context.CancelFunc{}
+	send := func(req *http.Request, backend *Backend) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[backend] = cancel
+		transport := t.transport(t.primary)
+		if backend != nil {
+			transport = t.transport(backend)
+		}
+		go func() {
+			resp, err := transport.RoundTrip(req.WithContext(ctx))
+			results <- hedgeResult{resp, err, backend, cancel}
+		}()
+	}
+	send(req, nil)
+
+	timer := time.NewTimer(t.policy.delay())
+	defer timer.Stop()
+
+	pending := 1
+	var hedge *Backend
+	for {
+		select {
+		case <-timer.C:
+			if !t.policy.budget.spend() {
+				continue
+			}
+			hedge = t.pool.NextServerExcept(req, t.https, []*Backend{t.primary})
+			if hedge == nil {
+				continue
+			}
+			hedged := req.Clone(req.Context())
+			u := *t.inbound.URL
+			hedged.URL = &u
+			rewriteToBackend(&httputil.ProxyRequest{In: t.inbound, Out: hedged}, hedge)
+			send(hedged, hedge)
+			pending++
+
+		case res := <-results:
+			pending--
+			if res.backend != nil {
+				res.backend.observeLatency(time.Since(start))
+				res.backend.report(res.err == nil && res.resp.StatusCode < http.StatusInternalServerError)
+			}
+			if res.err != nil {
+				res.cancel()
+				if res.backend != nil {
+					res.backend.end()
+				}
+				// The other request might still succeed
+				if pending > 0 {
+					// The failure of the primary backend is reported here, as the hedged response would hide it
+					if res.backend == nil && req.Context().Err() == nil {
+						t.primary.report(false)
+						t.primaryReported = true
+					}
+					continue
+				}
+				return nil, res.err
+			}
+
+			t.policy.observe(time.Since(start))
+			if pending > 0 {
+				for backend, cancel := range cancels {
+					if backend != res.backend {
+						cancel()
+					}
+				}
+				go discardHedgeResult(results)
+			}
+			if res.backend != nil {
+				log.Printf("Hedged request %s %s was answered by %s", req.Method, req.URL.Path, res.backend.URL)
+				t.hedgeWinner = res.backend
+				// The primary backend took at least that long, which its latency average has to reflect
+				if !t.primaryReported {
+					t.primary.observeLatency(time.Since(start))
+				}
+			}
+			res.resp.Body = &hedgeBody{ReadCloser: res.resp.Body, result: res}
+			return res.resp, nil
+		}
+	}
+}
+
+// discardHedgeResult releases the resources of the cancelled request that lost the race
+func discardHedgeResult(results chan hedgeResult) {
+	res := <-results
+	if res.resp != nil {
+		res.resp.Body.Close()
+	}
+	if res.backend != nil {
+		res.backend.end()
+	}
+}
+
+// hedgeBody releases the resources of the winning request once its body is closed
+type hedgeBody struct {
+	io.ReadCloser
+	result hedgeResult
+	once   sync.Once
+}
+
+func (b *hedgeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.result.cancel()
+		if b.result.backend != nil {
+			b.result.backend.end()
+		}
+	})
+	return err
+}
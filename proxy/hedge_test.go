@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHedge_SlowBackendIsHedged(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	slowUrl, _ := url.Parse(slow.URL)
+	fastUrl, _ := url.Parse(fast.URL)
+	pool := NewServerPool(testBackends([]*url.URL{slowUrl, fastUrl}), nil)
+	handler := ProxyHandler(pool, false, false, Options{Hedge: NewHedgePolicy(HedgeConfig{Delay: 20 * time.Millisecond})})
+
+	// The round-robin balancer sends the first request to the slow backend
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Body.String() != "fast" {
+		t.Errorf("Expected the response from the fast backend, got %q", rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Hedged request took %v", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Request to the slow backend was not cancelled")
+	}
+
+	waitFor(t, func() bool { return pool.httpServers[0].Active() == 0 && pool.httpServers[1].Active() == 0 })
+}
+
+func TestHedge_PostIsNotHedged(t *testing.T) {
+	policy := NewHedgePolicy(HedgeConfig{Delay: time.Millisecond})
+	if policy.eligible(httptest.NewRequest("POST", "/", nil)) {
+		t.Errorf("POST requests should not be hedged")
+	}
+	if !policy.eligible(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("GET requests should be hedged")
+	}
+}
+
+func TestHedge_PercentileDelay(t *testing.T) {
+	policy := NewHedgePolicy(HedgeConfig{Delay: time.Second, Percentile: 90})
+	if d := policy.delay(); d != time.Second {
+		t.Errorf("Expected the fixed delay before enough samples, got %v", d)
+	}
+
+	for i := 1; i <= 100; i++ {
+		policy.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := policy.delay(); d < 89*time.Millisecond || d > 91*time.Millisecond {
+		t.Errorf("Expected the 90th percentile of about 90ms, got %v", d)
+	}
+}
+
+func TestHedge_HedgedRequestKeepsBackendPath(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	paths := make(chan string, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+	}))
+	defer fast.Close()
+
+	slowUrl, _ := url.Parse(slow.URL + "/v1")
+	fastUrl, _ := url.Parse(fast.URL + "/v2")
+	pool := NewServerPool(testBackends([]*url.URL{slowUrl, fastUrl}), nil)
+	handler := ProxyHandler(pool, false, false, Options{Hedge: NewHedgePolicy(HedgeConfig{Delay: 20 * time.Millisecond})})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items?page=2", nil))
+
+	if path := <-paths; path != "/v2/items?page=2" {
+		t.Errorf("Expected the hedged request to keep the backend path, got %s", path)
+	}
+}
+
+func TestHedge_PrimaryFailureIsReported(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection is dropped once the hedged request is sent
+		time.Sleep(50 * time.Millisecond)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	failingUrl, _ := url.Parse(failing.URL)
+	slowUrl, _ := url.Parse(slow.URL)
+	pool := NewServerPool(testBackends([]*url.URL{failingUrl, slowUrl}), nil)
+	pool.EnableOutlierDetection(OutlierDetectionConfig{ConsecutiveFailures: 1, Cooldown: time.Minute})
+	handler := ProxyHandler(pool, false, false, Options{Hedge: NewHedgePolicy(HedgeConfig{Delay: 20 * time.Millisecond})})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Body.String() != "slow" {
+		t.Fatalf("Expected the response of the hedged backend, got %q", rec.Body.String())
+	}
+	if pool.httpServers[0].Available() {
+		t.Errorf("Expected the failure of the primary backend to eject it")
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig configures the traffic mirroring of a route
+type MirrorConfig struct {
+	// Percent of the requests copied to the shadow pool
+	Percent float64
+	// MaxBodySize is the largest request body mirrored. Requests with larger bodies are not mirrored
+	MaxBodySize int64
+	// Timeout of the shadow requests
+	Timeout time.Duration
+	// MaxConcurrent limits the number of shadow requests in flight. Further requests are not mirrored
+	MaxConcurrent int
+	// SkipCertCheck disables verification of the shadow backend certificates
+	SkipCertCheck bool
+}
+
+// Mirror asynchronously copies requests to a shadow pool and discards the responses,
+// so the shadow backends never affect the latency or the result seen by the client
+type Mirror struct {
+	Pool *ServerPool
+	// Diff compares the shadow responses with the primary ones. Disabled if nil
+	Diff     *ResponseDiff
+	cfg      MirrorConfig
+	client   *http.Client
+	inFlight chan struct{}
+
+	mirrored   atomic.Int64
+	skipped    atomic.Int64
+	failures   atomic.Int64
+	compared   atomic.Int64
+	mismatches atomic.Int64
+}
+
+// MirrorStats counts the requests of a Mirror
+type MirrorStats struct {
+	// Mirrored is the number of requests sent to the shadow pool
+	Mirrored int64 `json:"mirrored"`
+	// Skipped is the number of sampled requests not mirrored because of their body size or the concurrency limit
+	Skipped int64 `json:"skipped"`
+	// Failures is the number of shadow requests that failed or got a server error
+	Failures int64 `json:"failures"`
+	// Compared is the number of shadow responses compared with the primary ones
+	Compared int64 `json:"compared"`
+	// Mismatches is the number of shadow responses not matching the primary ones
+	Mismatches int64 `json:"mismatches"`
+}
+
+// NewMirror creates a new Mirror copying requests to the pool
+func NewMirror(pool *ServerPool, cfg MirrorConfig) *Mirror {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig := backendTLSConfig(pool, nil, cfg.SkipCertCheck); tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &Mirror{
+		Pool: pool,
+		cfg:  cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			// Redirects are the response of the shadow backend, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, max(cfg.MaxConcurrent, 1)),
+	}
+}
+
+// Stats returns the request counters of the mirror
+func (m *Mirror) Stats() MirrorStats {
+	return MirrorStats{
+		Mirrored:   m.mirrored.Load(),
+		Skipped:    m.skipped.Load(),
+		Failures:   m.failures.Load(),
+		Compared:   m.compared.Load(),
+		Mismatches: m.mismatches.Load(),
+	}
+}
+
+// mirror copies a sample of the requests to the shadow pool. The request body is buffered up to the size cap
+// and left readable for the primary backend. If the responses are compared, the primary response has to be written
+// to the returned writer. The returned function must be called once the primary response is complete
+func (m *Mirror) mirror(w http.ResponseWriter, r *http.Request, https bool) (http.ResponseWriter, func()) {
+	if m == nil || rand.Float64()*100 >= m.cfg.Percent {
+		return w, func() {}
+	}
+	body, ok := m.bufferBody(r)
+	if !ok {
+		m.skipped.Add(1)
+		return w, func() {}
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return w, func() {}
+	}
+	// The copy is made before the primary request is proxied, which may modify it
+	out := r.Clone(context.Background())
+	if m.Diff == nil {
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.send(out, body, https)
+		}()
+		return w, func() {}
+	}
+
+	method, target := r.Method, r.URL.String()
+	capture := &responseCapture{ResponseWriter: w, limit: m.Diff.cfg.MaxBodySize}
+	primary := make(chan *capturedResponse, 1)
+	go func() {
+		defer func() { <-m.inFlight }()
+		shadow := m.send(out, body, https)
+		if shadow == nil {
+			return
+		}
+		// Streamed primary responses may take longer than the shadow timeout, in which case they are not compared
+		timer := time.NewTimer(m.cfg.Timeout)
+		defer timer.Stop()
+		select {
+		case resp := <-primary:
+			m.compared.Add(1)
+			if !m.Diff.compare(method, target, resp, shadow) {
+				m.mismatches.Add(1)
+			}
+		case <-timer.C:
+		}
+	}()
+	return capture, func() { primary <- capture.captured() }
+}
+
+// bufferBody reads the request body into memory so it can be sent to both pools.
+// It reports false if the body is too large, in which case the request body is left readable as is
+func (m *Mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.cfg.MaxBodySize {
+		return nil, false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, m.cfg.MaxBodySize+1))
+	if err != nil || int64(len(buf)) > m.cfg.MaxBodySize {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	return buf, true
+}
+
+// send sends the copy of the request to the next backend of the shadow pool. The response is only kept if it's
+// compared with the primary one. Failures are only counted, logging them would flood the log when the shadow
+// backends are down
+func (m *Mirror) send(out *http.Request, body []byte, https bool) *capturedResponse {
+	backend := m.Pool.NextServer(out, https)
+	if backend == nil {
+		m.failures.Add(1)
+		return nil
+	}
+	defer backend.end()
+	m.mirrored.Add(1)
+
+	// The path is joined with the backend path and the X-Forwarded headers are extended the same way as for
+	// the primary requests
+	in := *out
+	pr := &httputil.ProxyRequest{In: &in, Out: out}
+	rewriteToBackend(pr, backend)
+	out.RequestURI = ""
+	out.Body = nil
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	removeHopHeaders(out.Header)
+	pr.SetXForwarded()
+
+	start := time.Now()
+	resp, err := m.client.Do(out)
+	if err != nil {
+		backend.report(false)
+		m.failures.Add(1)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var shadow *capturedResponse
+	if m.Diff != nil {
+		shadow = &capturedResponse{status: resp.StatusCode, header: resp.Header}
+		shadow.body, err = io.ReadAll(io.LimitReader(resp.Body, m.Diff.cfg.MaxBodySize+1))
+		if int64(len(shadow.body)) > m.Diff.cfg.MaxBodySize {
+			shadow.body, shadow.truncated = nil, true
+		}
+	}
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+
+	backend.observeLatency(time.Since(start))
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	backend.report(!failed)
+	if failed {
+		m.failures.Add(1)
+	}
+	if err != nil {
+		return nil
+	}
+	return shadow
+}
+
+// hopHeaders are the hop-by-hop headers, which are not forwarded to the backends
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, hdr := range hopHeaders {
+		h.Del(hdr)
+	}
+}
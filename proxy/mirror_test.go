@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirror_CopiesRequestsToShadowPool(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+
+	var shadowBody atomic.Value
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBody.Store(string(body))
+		// A slow failing shadow backend must not affect the client
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	primaryURL, _ := url.Parse(primary.URL)
+	shadowURL, _ := url.Parse(shadow.URL)
+	route, err := NewRoute("api", "/", NewServerPool(testBackends([]*url.URL{primaryURL}), nil))
+	if err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	route.Mirror = NewMirror(NewServerPool(testBackends([]*url.URL{shadowURL}), nil), MirrorConfig{
+		Percent:       100,
+		MaxBodySize:   1024,
+		Timeout:       time.Second,
+		MaxConcurrent: 10,
+	})
+	router := NewRouter(nil)
+	router.Add(route)
+	handler := RoutingHandler(NewVirtualHosts(router), false, Options{})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/orders", strings.NewReader("order")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "order" {
+		t.Fatalf("Expected the primary response, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	waitFor(t, func() bool { return shadowBody.Load() == "order" })
+	release <- struct{}{}
+	waitFor(t, func() bool { return route.Mirror.Stats().Failures == 1 })
+
+	// Requests with bodies over the cap are only sent to the primary pool
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/orders", strings.NewReader(strings.Repeat("x", 2048))))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 2048 {
+		t.Fatalf("Expected the full body to reach the primary, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if stats := route.Mirror.Stats(); stats.Mirrored != 1 || stats.Skipped != 1 {
+		t.Errorf("Expected 1 mirrored and 1 skipped request, got %+v", stats)
+	}
+}
+
+func TestMirror_KeepsShadowBackendPath(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+	var shadowPath atomic.Value
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowPath.Store(r.URL.RequestURI())
+	}))
+	defer shadow.Close()
+
+	primaryURL, _ := url.Parse(primary.URL)
+	shadowURL, _ := url.Parse(shadow.URL + "/v2")
+	route, _ := NewRoute("api", "/", NewServerPool(testBackends([]*url.URL{primaryURL}), nil))
+	route.Mirror = NewMirror(NewServerPool(testBackends([]*url.URL{shadowURL}), nil), MirrorConfig{
+		Percent:       100,
+		MaxBodySize:   1024,
+		Timeout:       time.Second,
+		MaxConcurrent: 10,
+	})
+	router := NewRouter(nil)
+	router.Add(route)
+	RoutingHandler(NewVirtualHosts(router), false, Options{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders?id=1", nil))
+
+	waitFor(t, func() bool { return shadowPath.Load() == "/v2/orders?id=1" })
+}
+
+func TestMirror_ExtendsForwardedFor(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+	var forwardedFor atomic.Value
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor.Store(r.Header.Get("X-Forwarded-For"))
+	}))
+	defer shadow.Close()
+
+	primaryURL, _ := url.Parse(primary.URL)
+	shadowURL, _ := url.Parse(shadow.URL)
+	route, _ := NewRoute("api", "/", NewServerPool(testBackends([]*url.URL{primaryURL}), nil))
+	route.Mirror = NewMirror(NewServerPool(testBackends([]*url.URL{shadowURL}), nil), MirrorConfig{
+		Percent:       100,
+		MaxBodySize:   1024,
+		Timeout:       time.Second,
+		MaxConcurrent: 10,
+	})
+	router := NewRouter(nil)
+	router.Add(route)
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	RoutingHandler(NewVirtualHosts(router), false, Options{}).ServeHTTP(httptest.NewRecorder(), req)
+
+	waitFor(t, func() bool { return forwardedFor.Load() == "203.0.113.7, 192.0.2.1" })
+}
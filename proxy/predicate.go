@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Predicate matches requests by their attributes other than the path, e.g. headers or query parameters
+type Predicate interface {
+	Matches(r *http.Request) bool
+}
+
+// Condition matches a single request attribute
+type Condition struct {
+	// Source is one of "header", "cookie", "query" or "method"
+	Source string
+	// Name of the header, cookie or query parameter
+	Name string
+	// Value the attribute must be equal to. The attribute only has to be present if both Value and Regexp are empty
+	Value string
+	// Regexp the attribute must match. Used instead of the value if set
+	Regexp *regexp.Regexp
+}
+
+func (c *Condition) Matches(r *http.Request) bool {
+	var value string
+	present := true
+	switch c.Source {
+	case "header":
+		values := r.Header.Values(c.Name)
+		present = len(values) > 0
+		value = strings.Join(values, ",")
+	case "cookie":
+		cookie, err := r.Cookie(c.Name)
+		present = err == nil
+		if present {
+			value = cookie.Value
+		}
+	case "query":
+		query := r.URL.Query()
+		present = query.Has(c.Name)
+		value = query.Get(c.Name)
+	case "method":
+		value = r.Method
+	}
+
+	switch {
+	case !present:
+		return false
+	case c.Regexp != nil:
+		return c.Regexp.MatchString(value)
+	case c.Value != "":
+		return value == c.Value
+	}
+	return true
+}
+
+// AllOf matches requests matching all of the predicates
+type AllOf []Predicate
+
+func (a AllOf) Matches(r *http.Request) bool {
+	for _, p := range a {
+		if !p.Matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnyOf matches requests matching any of the predicates
+type AnyOf []Predicate
+
+func (a AnyOf) Matches(r *http.Request) bool {
+	for _, p := range a {
+		if p.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePredicate parses conditions combined with "&" (AND) and "|" (OR), where AND binds tighter than OR.
+// A condition is "method=GET", "header:X-Tenant=acme", "cookie:beta", "query:version~^beta" and so on:
+// "=" compares the value and "~" matches it against a regular expression, neither of which can be empty, and the attribute
+// only has to be present if neither is given. For example "header:X-Tenant=acme&method=GET|query:version=beta".
+// A "|" or "&" within a regular expression belongs to it when it's escaped or inside parentheses or brackets,
+// e.g. "header:X-Tenant~^(acme|globex)$"
+func ParsePredicate(expr string) (Predicate, error) {
+	conds, ops := splitConditions(expr)
+	var anyOf AnyOf
+	var allOf AllOf
+	for i, cond := range conds {
+		c, err := parseCondition(strings.TrimSpace(cond))
+		if err != nil {
+			return nil, err
+		}
+		allOf = append(allOf, c)
+		if i == len(ops) || ops[i] == '|' {
+			anyOf = append(anyOf, allOf)
+			allOf = nil
+		}
+	}
+	return anyOf, nil
+}
+
+// splitConditions splits the expression into its conditions and the operators between them. The regular expression
+// of a condition is read as a whole, so the operators escaped or inside its parentheses or brackets are part of it
+func splitConditions(expr string) (conds []string, ops []byte) {
+	start := 0
+	operand, re, class, depth := false, false, false, 0
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case re && c == '\\':
+			i++
+		case re && class:
+			class = c != ']'
+		case re && c == '[':
+			class = true
+		case re && c == '(':
+			depth++
+		case re && c == ')':
+			depth--
+		case !operand && (c == '=' || c == '~'):
+			operand, re = true, c == '~'
+		case (c == '|' || c == '&') && depth <= 0:
+			conds = append(conds, expr[start:i])
+			ops = append(ops, c)
+			start = i + 1
+			operand, re, class, depth = false, false, false, 0
+		}
+	}
+	return append(conds, expr[start:]), ops
+}
+
+func parseCondition(cond string) (*Condition, error) {
+	i := strings.IndexAny(cond, "=~")
+	attr, op, operand := cond, byte(0), ""
+	if i >= 0 {
+		attr, op, operand = cond[:i], cond[i], cond[i+1:]
+	}
+
+	c := &Condition{}
+	c.Source, c.Name, _ = strings.Cut(attr, ":")
+	switch c.Source {
+	case "header", "cookie", "query":
+		if c.Name == "" {
+			return nil, fmt.Errorf("condition %q requires a name, e.g. %s:name", cond, c.Source)
+		}
+	case "method":
+		if op == 0 {
+			return nil, fmt.Errorf("condition %q requires a value", cond)
+		}
+	default:
+		return nil, fmt.Errorf("unknown condition source %q in %q", c.Source, cond)
+	}
+
+	if op != 0 && operand == "" {
+		return nil, fmt.Errorf("condition %q requires a value after %q", cond, op)
+	}
+	switch op {
+	case '=':
+		c.Value = operand
+	case '~':
+		re, err := regexp.Compile(operand)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %v", cond, err)
+		}
+		c.Regexp = re
+	}
+	return c, nil
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePredicate(t *testing.T) {
+	predicate, err := ParsePredicate("header:X-Tenant=acme&method=GET|query:version~^beta|cookie:internal")
+	if err != nil {
+		t.Fatalf("Failed to parse predicate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   string
+		cookie   bool
+		expected bool
+	}{
+		{"tenant and method", "GET", "/", "acme", false, true},
+		{"tenant with another method", "POST", "/", "acme", false, false},
+		{"another tenant", "GET", "/", "other", false, false},
+		{"beta query", "POST", "/?version=beta2", "", false, true},
+		{"stable query", "POST", "/?version=stable", "", false, false},
+		{"cookie presence", "POST", "/", "", true, true},
+		{"nothing", "GET", "/", "", false, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if test.header != "" {
+			req.Header.Set("X-Tenant", test.header)
+		}
+		if test.cookie {
+			req.AddCookie(&http.Cookie{Name: "internal", Value: "1"})
+		}
+		if matches := predicate.Matches(req); matches != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, matches)
+		}
+	}
+}
+
+func TestParsePredicate_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "header=acme", "method", "query:v~(", "path=/api", "method=", "header:X-Tenant=", "query:version~", "method=GET&cookie:beta="} {
+		if _, err := ParsePredicate(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestRouter_PredicatesInPriorityOrder(t *testing.T) {
+	defaultPool := NewServerPool(nil, nil)
+	apiPool := NewServerPool(nil, nil)
+	acmePool := NewServerPool(nil, nil)
+	betaPool := NewServerPool(nil, nil)
+
+	router := NewRouter(defaultPool)
+	mustAddRoute(t, router, "api", "/api/", apiPool)
+	router.Add(mustNewRoute(t, "acme", "/", acmePool, "header:X-Tenant=acme", 10))
+	router.Add(mustNewRoute(t, "beta", "/", betaPool, "query:version=beta", 5))
+
+	tests := []struct {
+		target   string
+		tenant   string
+		expected *ServerPool
+	}{
+		{"/api/orders", "", apiPool},
+		{"/api/orders", "acme", acmePool},
+		{"/api/orders?version=beta", "", betaPool},
+		{"/api/orders?version=beta", "acme", acmePool},
+		{"/index.html", "", defaultPool},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		if test.tenant != "" {
+			req.Header.Set("X-Tenant", test.tenant)
+		}
+		if route := router.Match(req); route.Pool != test.expected {
+			t.Errorf("%s with tenant %q was routed to %s", test.target, test.tenant, route.Name)
+		}
+	}
+}
+
+func mustNewRoute(t *testing.T, name string, pattern string, pool *ServerPool, predicate string, priority int) *Route {
+	t.Helper()
+	route, err := NewRoute(name, pattern, pool)
+	if err != nil {
+		t.Fatalf("Failed to create route %s: %v", name, err)
+	}
+	if route.Predicate, err = ParsePredicate(predicate); err != nil {
+		t.Fatalf("Failed to parse predicate of route %s: %v", name, err)
+	}
+	route.Priority = priority
+	return route
+}
+
+func TestParsePredicate_RegexpOperators(t *testing.T) {
+	predicate, err := ParsePredicate(`header:X-Tenant~^(acme|globex)$&query:v~[|&]|query:op~a\|b`)
+	if err != nil {
+		t.Fatalf("Failed to parse predicate: %v", err)
+	}
+	anyOf := predicate.(AnyOf)
+	if len(anyOf) != 2 || len(anyOf[0].(AllOf)) != 2 || len(anyOf[1].(AllOf)) != 1 {
+		t.Fatalf("Unexpected structure %+v", anyOf)
+	}
+
+	tests := []struct {
+		tenant   string
+		target   string
+		expected bool
+	}{
+		{"globex", "/?v=|", true},
+		{"acme", "/?v=%26", true},
+		{"acme", "/?v=x", false},
+		{"initech", "/?v=|", false},
+		{"", "/?op=a|b", true},
+		{"", "/?op=ab", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		if test.tenant != "" {
+			req.Header.Set("X-Tenant", test.tenant)
+		}
+		if matches := predicate.Matches(req); matches != test.expected {
+			t.Errorf("%s %s: expected %v, got %v", test.tenant, test.target, test.expected, matches)
+		}
+	}
+}
@@ -1,16 +1,18 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,8 +22,6 @@ var upgrader = &websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-var dialer = websocket.DefaultDialer
-
 // Interface for waiting for connections to close
 var ActiveConnWaiter ConnWaiter
 
@@ -38,39 +38,204 @@ func init() {
 	ActiveConnWaiter = connWaitGroup
 }
 
+// Options configures the ProxyHandler
+type Options struct {
+	// SkipCertCheck disables verification of the backend certificates of the pools without a TLS configuration
+	SkipCertCheck bool
+	// TLSConfig configures the TLS connections to the backends, both HTTP and WebSocket,
+	// e.g. with the CA bundle, the server name or the client certificates. The defaults are used if nil.
+	// The configuration of the pool takes precedence, see ServerPool.SetTLSConfig
+	TLSConfig *tls.Config
+	// Affinity pins clients to backends with a cookie. Disabled if nil
+	Affinity *Affinity
+	// Retry retries failed requests on other backends. Disabled if nil
+	Retry *RetryPolicy
+	// WebSocketDialAttempts is the number of backends tried before a WebSocket connection fails.
+	// Only one backend is tried if 0
+	WebSocketDialAttempts int
+	// WebSocketDialTimeout limits the total time spent dialing the backends. Unlimited if 0
+	WebSocketDialTimeout time.Duration
+	// Hedge sends duplicates of slow read-only requests to other backends. Disabled if nil
+	Hedge *HedgePolicy
+	// Transports keep the connections to the backends open across requests. Shared default transports are used if nil
+	Transports *Transports
+}
+
+// backendTLSConfig returns the TLS configuration of the connections to the pool backends, or nil if the defaults are used
+func (opts Options) backendTLSConfig(pool *ServerPool) *tls.Config {
+	return backendTLSConfig(pool, opts.TLSConfig, opts.SkipCertCheck)
+}
+
 // ProxyHandler returns a handler that forwards requests to the next server in the pool
-func ProxyHandler(pool *ServerPool, ws bool, https bool, skipCertCheck bool) http.Handler {
+func ProxyHandler(pool *ServerPool, ws bool, https bool, opts Options) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var server *url.URL
-		if https {
-			server = pool.NextHttpsServer()
-		} else {
-			server = pool.NextHttpServer()
+		serveProxy(pool, ws, https, w, r, opts)
+	})
+}
+
+// RoutingHandler returns a handler that forwards requests to the pool of the route matching the request host and path.
+// The path is rewritten according to the route before it's forwarded.
+// WebSocket upgrade requests are proxied as WebSocket connections regardless of the path
+func RoutingHandler(hosts *VirtualHosts, https bool, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router := hosts.Router(r)
+		if router == nil {
+			log.Printf("Unknown host %s", r.Host)
+			http.Error(w, http.StatusText(hosts.UnknownHostStatus), hosts.UnknownHostStatus)
+			return
+		}
+		route := router.Match(r)
+		if route == nil {
+			log.Printf("No route for %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		r = route.Rewrite.request(r)
+		if route.Redirect != nil {
+			http.Redirect(w, r, route.Redirect.location(r), route.Redirect.Status)
+			return
+		}
+
+		ws := websocket.IsWebSocketUpgrade(r)
+		if !ws {
+			var done func()
+			w, done = route.Mirror.mirror(w, r, https)
+			defer done()
+		}
+		serveProxy(route.ServerPool(r), ws, https, w, r, opts)
+	})
+}
+
+// serveProxy forwards the request to the next server in the pool
+func serveProxy(pool *ServerPool, ws bool, https bool, w http.ResponseWriter, r *http.Request, opts Options) {
+	backend := opts.Affinity.pinned(pool, r, https)
+	pin := backend == nil
+	if backend == nil {
+		backend = pool.NextServer(r, https)
+		if backend == nil {
+			log.Printf("No healthy backends available for %s", r.URL)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if ws {
+		proxyWebSocket(pool, backend, pin, https, w, r, opts)
+	} else {
+		proxyHTTP(pool, backend, pin, https, w, r, opts)
+	}
+}
+
+// proxyHTTP forwards the request to the backend, retrying it on other backends according to the retry policy
+func proxyHTTP(pool *ServerPool, backend *Backend, pin bool, https bool, w http.ResponseWriter, r *http.Request, opts Options) {
+	var body []byte
+	// The retry budget is a percentage of all the requests, whether they can be retried or not
+	opts.Retry.countRequest()
+	retryable := opts.Retry.retryable(r)
+	if retryable {
+		body, retryable = opts.Retry.bufferBody(r)
+	}
+
+	var tried []*Backend
+	for {
+		tried = append(tried, backend)
+		canRetry := retryable && len(tried) < opts.Retry.cfg.MaxAttempts && pool.HasAvailable(https, tried)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		retry := proxyAttempt(pool, backend, pin, https, w, r, opts, func() bool {
+			return canRetry && opts.Retry.allowRetry()
+		})
+		// The backend counts the request as in-flight until it's completed
+		backend.end()
+		if !retry {
+			return
+		}
+
+		backend = pool.NextServerExcept(r, https, tried)
+		if backend == nil {
+			// The remaining backends went down in the meantime
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		// The client is pinned to the backend that actually served the request
+		pin = true
+	}
+}
+
+// proxyAttempt forwards the request to the backend once. It reports whether the request failed and has
+// to be retried, in which case nothing is written to the client
+func proxyAttempt(pool *ServerPool, backend *Backend, pin bool, https bool, w http.ResponseWriter, r *http.Request, opts Options, shouldRetry func() bool) bool {
+	ctx := r.Context()
+	stopTimer := func() bool { return false }
+	if opts.Retry != nil && opts.Retry.cfg.PerTryTimeout > 0 {
+		// The per-try timeout only limits the time to the response headers, the body is streamed as long as needed
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stopTimer = time.AfterFunc(opts.Retry.cfg.PerTryTimeout, cancel).Stop
+		defer stopTimer()
+	}
+
+	transports := opts.Transports
+	if transports == nil {
+		transports = defaultTransports
+	}
+	a := &attempt{}
+	if opts.Hedge.eligible(r) {
+		a.hedge = &hedgedTransport{
+			transport: func(b *Backend) http.RoundTripper { return transports.transport(pool, b, opts) },
+			policy:    opts.Hedge,
+			pool:      pool,
+			https:     https,
+			primary:   backend,
+			inbound:   r,
 		}
+	}
 
-		if ws {
-			proxyWebSocket(server, w, r)
+	retry := false
+	start := time.Now()
+	a.modifyResponse = func(resp *http.Response) error {
+		stopTimer()
+		// The hedged backend that answered has already been accounted for by the transport
+		answered := backend
+		if a.hedge != nil && a.hedge.hedgeWinner != nil {
+			answered = a.hedge.hedgeWinner
 		} else {
-			proxy := &httputil.ReverseProxy{
-				Rewrite: func(r *httputil.ProxyRequest) {
-					r.SetURL(server)
-					r.Out.Host = r.In.Host
-					r.SetXForwarded()
-				},
-			}
-			if skipCertCheck {
-				proxy.Transport = &http.Transport{
-					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-				}
+			backend.observeLatency(time.Since(start))
+			backend.report(resp.StatusCode < http.StatusInternalServerError)
+		}
+		if opts.Retry.retryableStatus(resp.StatusCode) && shouldRetry() {
+			retry = true
+			return fmt.Errorf("retryable status %d", resp.StatusCode)
+		}
+		if pin || answered != backend {
+			opts.Affinity.pin(resp.Header, r, answered)
+		}
+		return nil
+	}
+	a.errorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// Requests cancelled by the client don't tell anything about the backend
+		if !retry && r.Context().Err() == nil {
+			if a.hedge == nil || !a.hedge.primaryReported {
+				backend.report(false)
 			}
-			proxy.ServeHTTP(w, r)
+			retry = shouldRetry()
 		}
-	})
+		if retry {
+			log.Printf("Retrying request %s %s on another backend after %s failed: %v", r.Method, r.URL, backend.URL, err)
+			return
+		}
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	transports.backendProxy(pool, backend, opts).proxy.ServeHTTP(w, r.WithContext(withAttempt(ctx, a)))
+	return retry
 }
 
 // Proxy WebSocket connections
-func proxyWebSocket(server *url.URL, rw http.ResponseWriter, req *http.Request) {
-
+func proxyWebSocket(pool *ServerPool, backend *Backend, pin bool, https bool, rw http.ResponseWriter, req *http.Request, opts Options) {
 	// Copy the headers from the incoming request to the dialer
 	requestHeader := http.Header{}
 	if origin := req.Header.Get("Origin"); origin != "" {
@@ -99,15 +264,16 @@ func proxyWebSocket(server *url.URL, rw http.ResponseWriter, req *http.Request)
 		requestHeader.Set("X-Forwarded-Proto", "https")
 	}
 
-	// Create a connection to the backend server
-	urlStr := fmt.Sprintf("ws://%s%s", server.Host, req.URL.Path)
-	connToBackend, resp, err := dialer.Dial(urlStr, requestHeader)
+	// Create a connection to the backend server, trying other backends if it fails
+	first := backend
+	backend, connToBackend, resp, err := dialBackend(pool, backend, https, requestHeader, req, opts)
 
+	// The backend counts the WebSocket connection as open until it's closed
+	defer backend.end()
 	connWaitGroup.Add(1)
 	defer connWaitGroup.Done()
 
 	if err != nil {
-		log.Printf("Couldn't dial to remote backend '%s' %s", server.String(), err)
 		if resp != nil {
 			// If response is not nil, copy it to the client
 			if err := copyResponse(rw, resp); err != nil {
@@ -120,13 +286,22 @@ func proxyWebSocket(server *url.URL, rw http.ResponseWriter, req *http.Request)
 	}
 	defer connToBackend.Close()
 
+	// The client is pinned to the backend that actually accepted the connection
+	if pin || backend != first {
+		opts.Affinity.pin(rw.Header(), req, backend)
+	}
+
 	// Copy the headers from the Dial handshake to the upgrader
+	// along with the cookies set by the proxy itself, e.g. session affinity
 	upgradeHeader := http.Header{}
 	if hdr := resp.Header.Get("Sec-Websocket-Protocol"); hdr != "" {
 		upgradeHeader.Set("Sec-Websocket-Protocol", hdr)
 	}
+	for _, hdr := range rw.Header()["Set-Cookie"] {
+		upgradeHeader.Add("Set-Cookie", hdr)
+	}
 	if hdr := resp.Header.Get("Set-Cookie"); hdr != "" {
-		upgradeHeader.Set("Set-Cookie", hdr)
+		upgradeHeader.Add("Set-Cookie", hdr)
 	}
 
 	// Upgrading the request to a WebSocket connection.
@@ -157,6 +332,79 @@ func proxyWebSocket(server *url.URL, rw http.ResponseWriter, req *http.Request)
 	}
 }
 
+// dialBackend connects to the backend, trying the next backends of the pool if the dial fails.
+// It returns the backend the connection was made to, or the last tried one on failure
+func dialBackend(pool *ServerPool, backend *Backend, https bool, requestHeader http.Header, req *http.Request, opts Options) (*Backend, *websocket.Conn, *http.Response, error) {
+	ctx := req.Context()
+	if opts.WebSocketDialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.WebSocketDialTimeout)
+		defer cancel()
+	}
+
+	// Backend certificates are verified the same way as for HTTP requests
+	dialer := websocket.DefaultDialer
+	if tlsConfig := opts.backendTLSConfig(pool); tlsConfig != nil {
+		dialer = &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+			TLSClientConfig:  tlsConfig,
+		}
+	}
+
+	var tried []*Backend
+	for {
+		tried = append(tried, backend)
+		start := time.Now()
+		conn, resp, err := dialer.DialContext(ctx, webSocketURL(backend, req), requestHeader)
+
+		backend.observeLatency(time.Since(start))
+		failed := err != nil && (resp == nil || resp.StatusCode >= http.StatusInternalServerError)
+		backend.report(!failed)
+		if err == nil {
+			return backend, conn, resp, nil
+		}
+		log.Printf("Couldn't dial to remote backend '%s' %s", backend.URL.String(), err)
+
+		// Responses other than server errors are passed to the client as is
+		if !failed || len(tried) >= opts.WebSocketDialAttempts || ctx.Err() != nil {
+			return backend, nil, resp, err
+		}
+		next := pool.NextServerExcept(req, https, tried)
+		if next == nil {
+			return backend, nil, resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		backend.end()
+		backend = next
+	}
+}
+
+// webSocketURL returns the URL of the backend WebSocket endpoint. The scheme follows the backend URL,
+// so HTTPS backends are dialed with wss. As for HTTP requests, the path is appended to the backend path
+// and the query string is kept
+func webSocketURL(backend *Backend, req *http.Request) string {
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     backend.URL.Host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	if backend.URL.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	if prefix := strings.TrimSuffix(backend.URL.Path, "/"); prefix != "" {
+		u.Path = prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimSuffix(backend.URL.EscapedPath(), "/") + u.RawPath
+		}
+	}
+	return u.String()
+}
+
 // Copy messages between two WebSocket connections
 func copyMessages(dst, src *websocket.Conn, errChan chan error) {
 	for {
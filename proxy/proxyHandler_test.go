@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyHandler_NoHealthyBackends(t *testing.T) {
+	pool := NewServerPool(testBackends([]*url.URL{{Scheme: "http", Host: "server1.com"}}), nil)
+	pool.httpServers[0].SetAlive(false)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	ProxyHandler(pool, false, false, Options{}).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// RetryConfig configures retries of failed requests on other backends
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts including the first one. Retries are disabled if it's less than 2
+	MaxAttempts int
+	// Methods that are safe to retry. GET, HEAD, OPTIONS, TRACE, PUT and DELETE if empty
+	Methods []string
+	// Statuses retried in addition to connection errors, e.g. 502, 503
+	Statuses []int
+	// PerTryTimeout limits the time to the response headers of a single attempt. Unlimited if 0
+	PerTryTimeout time.Duration
+	// BudgetPercent limits retries to the percentage of the requests. Unlimited if 0
+	BudgetPercent float64
+	// MaxBodySize is the largest request body buffered to be replayed on retries
+	MaxBodySize int64
+	// IdempotencyHeader marks requests with other methods (e.g. POST) as safe to retry when present
+	IdempotencyHeader string
+}
+
+var defaultRetryMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+}
+
+// RetryPolicy decides whether failed requests are retried
+type RetryPolicy struct {
+	cfg    RetryConfig
+	budget *budget
+}
+
+// NewRetryPolicy creates a new RetryPolicy
+func NewRetryPolicy(cfg RetryConfig) *RetryPolicy {
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = defaultRetryMethods
+	}
+	return &RetryPolicy{cfg: cfg, budget: &budget{percent: cfg.BudgetPercent}}
+}
+
+// retryable reports whether the request may be retried at all
+func (p *RetryPolicy) retryable(r *http.Request) bool {
+	if p == nil || p.cfg.MaxAttempts < 2 {
+		return false
+	}
+	if slices.Contains(p.cfg.Methods, r.Method) {
+		return true
+	}
+	return p.cfg.IdempotencyHeader != "" && r.Header.Get(p.cfg.IdempotencyHeader) != ""
+}
+
+// retryableStatus reports whether the response status should be retried
+func (p *RetryPolicy) retryableStatus(code int) bool {
+	return p != nil && slices.Contains(p.cfg.Statuses, code)
+}
+
+// countRequest registers a request in the retry budget. It does nothing if the policy is nil
+func (p *RetryPolicy) countRequest() {
+	if p != nil {
+		p.budget.count()
+	}
+}
+
+// allowRetry reports whether the retry budget allows one more retry and spends it
+func (p *RetryPolicy) allowRetry() bool {
+	return p.budget.spend()
+}
+
+// bufferBody reads a small request body into memory, so it can be replayed on retries.
+// It reports false if the body is too large, in which case the request body is left readable as is
+func (p *RetryPolicy) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > p.cfg.MaxBodySize {
+		return nil, false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, p.cfg.MaxBodySize+1))
+	if err != nil || int64(len(buf)) > p.cfg.MaxBodySize {
+		// Whatever was read is put back in front of the rest of the body
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return buf, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
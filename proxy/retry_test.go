@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newRetryTestPool creates a pool whose first backend refuses connections
+func newRetryTestPool(t *testing.T, handler http.HandlerFunc) *ServerPool {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := httptest.NewServer(handler)
+	t.Cleanup(up.Close)
+
+	downUrl, _ := url.Parse(down.URL)
+	upUrl, _ := url.Parse(up.URL)
+	return NewServerPool(testBackends([]*url.URL{downUrl, upUrl}), nil)
+}
+
+func testRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:       2,
+		MaxBodySize:       1024,
+		IdempotencyHeader: "Idempotency-Key",
+	}
+}
+
+func TestRetry_IdempotentRequest(t *testing.T) {
+	pool := newRetryTestPool(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := ProxyHandler(pool, false, false, Options{Retry: NewRetryPolicy(testRetryConfig())})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+}
+
+func TestRetry_PostRequiresIdempotencyHeader(t *testing.T) {
+	pool := newRetryTestPool(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	handler := ProxyHandler(pool, false, false, Options{Retry: NewRetryPolicy(testRetryConfig())})
+
+	codes := map[int]int{}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+		codes[rec.Code]++
+	}
+	if codes[http.StatusBadGateway] != 1 {
+		t.Errorf("Expected one POST to fail without retries, got %v", codes)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("payload"))
+		req.Header.Set("Idempotency-Key", "key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Errorf("Expected the body to be replayed, got %d %q", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRetry_RetryableStatus(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+
+	unavailableUrl, _ := url.Parse(unavailable.URL)
+	okUrl, _ := url.Parse(ok.URL)
+	pool := NewServerPool(testBackends([]*url.URL{unavailableUrl, okUrl}), nil)
+
+	cfg := testRetryConfig()
+	cfg.Statuses = []int{http.StatusServiceUnavailable}
+	handler := ProxyHandler(pool, false, false, Options{Retry: NewRetryPolicy(cfg)})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	policy := NewRetryPolicy(RetryConfig{MaxAttempts: 2, BudgetPercent: 10})
+
+	for i := 0; i < 50; i++ {
+		policy.countRequest()
+	}
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if policy.allowRetry() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 retries within the budget, got %d", allowed)
+	}
+}
+
+func TestRetry_BudgetCountsAllRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+	policy := NewRetryPolicy(RetryConfig{MaxAttempts: 2, BudgetPercent: 10})
+	handler := ProxyHandler(NewServerPool(testBackends([]*url.URL{backendUrl}), nil), false, false, Options{Retry: policy})
+
+	// POST requests can't be retried, but they are part of the traffic the budget is a percentage of
+	for i := 0; i < 50; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	}
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if policy.allowRetry() {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 retries within the budget, got %d", allowed)
+	}
+}
+
+func TestRetry_LargeBodyIsNotBuffered(t *testing.T) {
+	policy := NewRetryPolicy(RetryConfig{MaxAttempts: 2, MaxBodySize: 4})
+	req := httptest.NewRequest("PUT", "/", io.NopCloser(strings.NewReader("payload")))
+	req.ContentLength = -1
+
+	if _, ok := policy.bufferBody(req); ok {
+		t.Fatalf("Body larger than the limit should not be buffered")
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "payload" {
+		t.Errorf("Body should be left intact, got %q", body)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rewrite rewrites the request path before it's forwarded to the backend. The prefix is stripped first,
+// then the regexp is replaced and finally the prefix is added, e.g. "/api/users" becomes "/v2/users"
+// with StripPrefix "/api" and AddPrefix "/v2"
+type Rewrite struct {
+	StripPrefix string
+	AddPrefix   string
+	// Regexp matched against the path. The matches are replaced by the replacement, which can refer
+	// to the capture groups, e.g. "$1" or "${name}"
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// NewRewrite creates a new Rewrite. The regexp is optional
+func NewRewrite(stripPrefix string, addPrefix string, expr string, replacement string) (*Rewrite, error) {
+	rw := &Rewrite{StripPrefix: stripPrefix, AddPrefix: addPrefix, Replacement: replacement}
+	if expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regexp: %v", err)
+		}
+		rw.Regexp = re
+	}
+	return rw, nil
+}
+
+// Path returns the rewritten path. It returns the path as is if the rewrite is nil
+func (rw *Rewrite) Path(path string) string {
+	if rw == nil {
+		return path
+	}
+	// The prefix is only stripped at a path segment boundary, so "/api" doesn't turn "/apiary" into "/ary"
+	if rest, ok := strings.CutPrefix(path, rw.StripPrefix); ok && rw.StripPrefix != "" &&
+		(rest == "" || rest[0] == '/' || strings.HasSuffix(rw.StripPrefix, "/")) {
+		path = rest
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rw.Regexp != nil {
+		path = rw.Regexp.ReplaceAllString(path, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+	return path
+}
+
+// request returns a shallow copy of the request with the rewritten path
+func (rw *Rewrite) request(r *http.Request) *http.Request {
+	if rw == nil {
+		return r
+	}
+	out := new(http.Request)
+	*out = *r
+	u := *r.URL
+	u.Path = rw.Path(r.URL.Path)
+	// The escaped path is derived from the rewritten one
+	u.RawPath = ""
+	out.URL = &u
+	return out
+}
+
+// Redirect answers the requests with a redirect instead of proxying them
+type Redirect struct {
+	// Status is one of 301, 302, 307 or 308
+	Status int
+	// Location the requests are redirected to, e.g. "https://example.com". The path of the request is appended to it,
+	// after the rewrite of the route if any. Relative to the request if empty
+	Location string
+}
+
+// ParseRedirect parses a redirect status optionally followed by the location, e.g. "301" or "308:https://example.com"
+func ParseRedirect(spec string) (*Redirect, error) {
+	rawStatus, location, _ := strings.Cut(spec, ":")
+	status, err := strconv.Atoi(rawStatus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect status %q", rawStatus)
+	}
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("unsupported redirect status %d", status)
+	}
+	return &Redirect{Status: status, Location: strings.TrimSuffix(location, "/")}, nil
+}
+
+// location returns the URL the request is redirected to
+func (rd *Redirect) location(r *http.Request) string {
+	location := rd.Location + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	return location
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRewrite_Path(t *testing.T) {
+	tests := []struct {
+		stripPrefix, addPrefix, expr, replacement string
+		path, expected                            string
+	}{
+		{"/api", "", "", "", "/api/users", "/users"},
+		{"/api", "", "", "", "/api", "/"},
+		{"/api", "", "", "", "/apiary", "/apiary"},
+		{"/api/", "", "", "", "/api/users", "/users"},
+		{"", "/v2", "", "", "/users", "/v2/users"},
+		{"/api", "/v2/", "", "", "/api/users", "/v2/users"},
+		{"", "", `^/users/(\d+)$`, "/accounts/$1", "/users/42", "/accounts/42"},
+		{"/api", "/v2", `^/users/(?P<id>\d+)/profile$`, "/profiles/${id}", "/api/users/42/profile", "/v2/profiles/42"},
+		{"", "", `^/users/(\d+)$`, "/accounts/$1", "/orders/42", "/orders/42"},
+	}
+	for _, tt := range tests {
+		rw, err := NewRewrite(tt.stripPrefix, tt.addPrefix, tt.expr, tt.replacement)
+		if err != nil {
+			t.Fatalf("Failed to create rewrite: %v", err)
+		}
+		if path := rw.Path(tt.path); path != tt.expected {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", tt.path, tt.expected, path)
+		}
+	}
+}
+
+func TestRoutingHandler_RewritesHTTPAndWebSocketPaths(t *testing.T) {
+	var paths []string
+	echo := newEchoServer(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.RequestURI())
+		echo.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	route, _ := NewRoute("api", "/api/", NewServerPool(testBackends([]*url.URL{backendUrl}), nil))
+	route.Rewrite, _ = NewRewrite("/api", "/v2", "", "")
+	router := NewRouter(nil)
+	router.Add(route)
+	proxy := httptest.NewServer(RoutingHandler(NewVirtualHosts(router), false, Options{}))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/api/users?active=true")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/api/events", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	conn.Close()
+
+	if len(paths) != 2 || paths[0] != "/v2/users?active=true" || !strings.HasPrefix(paths[1], "/v2/events") {
+		t.Errorf("Expected rewritten paths, got %v", paths)
+	}
+}
+
+func TestRoutingHandler_Redirects(t *testing.T) {
+	route, _ := NewRoute("old", "/old/", nil)
+	route.Rewrite, _ = NewRewrite("/old", "/new", "", "")
+	route.Redirect, _ = ParseRedirect("308:https://example.com/")
+	router := NewRouter(nil)
+	router.Add(route)
+	handler := RoutingHandler(NewVirtualHosts(router), false, Options{})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/old/orders?id=1", nil))
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected status code %d, got %d", http.StatusPermanentRedirect, rec.Code)
+	}
+	if location := rec.Header().Get("Location"); location != "https://example.com/new/orders?id=1" {
+		t.Errorf("Unexpected location %s", location)
+	}
+
+	if _, err := ParseRedirect("200"); err == nil {
+		t.Errorf("Expected an error for a status other than a redirect")
+	}
+}
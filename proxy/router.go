@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route maps the requests matching its path and predicate to a backend pool
+type Route struct {
+	Name string
+	// Prefix of the request path matched by the route, e.g. "/api/"
+	Prefix string
+	// Regexp matched against the request path. Used instead of the prefix if set
+	Regexp *regexp.Regexp
+	// Predicate the request must match in addition to the path. Ignored if nil
+	Predicate Predicate
+	// Priority of the route. Routes with higher priority are evaluated first
+	Priority int
+	Pool     *ServerPool
+	// Split splits the traffic between several pools. Used instead of the pool if set
+	Split *TrafficSplit
+	// Mirror copies the requests to a shadow pool. Disabled if nil
+	Mirror *Mirror
+	// Rewrite rewrites the path of the requests, both HTTP and WebSocket. Disabled if nil
+	Rewrite *Rewrite
+	// Redirect answers the requests with a redirect instead of proxying them. Disabled if nil
+	Redirect *Redirect
+}
+
+// ServerPool returns the pool the request is proxied to
+func (rt *Route) ServerPool(r *http.Request) *ServerPool {
+	if rt.Split != nil {
+		return rt.Split.Pick(r)
+	}
+	return rt.Pool
+}
+
+// NewRoute creates a new Route. Patterns starting with "~" are regular expressions, others are path prefixes
+func NewRoute(name string, pattern string, pool *ServerPool) (*Route, error) {
+	route := &Route{Name: name, Pool: pool}
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", name, err)
+		}
+		route.Regexp = re
+		return route, nil
+	}
+
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("route %s: prefix %q must start with /", name, pattern)
+	}
+	route.Prefix = pattern
+	return route, nil
+}
+
+// matches reports whether the request matches the route
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Regexp != nil {
+		if !rt.Regexp.MatchString(r.URL.Path) {
+			return false
+		}
+	} else if !strings.HasPrefix(r.URL.Path, rt.Prefix) {
+		return false
+	}
+	return rt.Predicate == nil || rt.Predicate.Matches(r)
+}
+
+// specificity is the length of the prefix shared by all the paths the route matches. Every path starts with "/",
+// so it's at least 1 for regexp routes
+func (rt *Route) specificity() int {
+	if rt.Regexp == nil {
+		return len(rt.Prefix)
+	}
+	prefix := ""
+	if expr, ok := strings.CutPrefix(rt.Regexp.String(), "^"); ok {
+		if re, err := regexp.Compile(expr); err == nil {
+			prefix, _ = re.LiteralPrefix()
+		}
+	}
+	return max(len(prefix), 1)
+}
+
+// Router is a routing table mapping requests to backend pools.
+// Routes are evaluated in priority order. Among the routes of the same priority the most specific one wins, i.e. the
+// one with the longest prefix. The prefix of a regexp route is the literal text following its "^" anchor, e.g. "/api/v"
+// for "^/api/v\d+/", and "/" if it's not anchored, so a "/" catch-all doesn't hide the regexp routes. Regexp routes
+// win over prefix routes of the same length and are tried in the order they were added among themselves.
+// The default pool is used when nothing matches at all
+type Router struct {
+	routes       []*Route
+	defaultRoute *Route
+}
+
+// NewRouter creates a new Router. The default pool might be nil, in which case unmatched requests are rejected
+func NewRouter(defaultPool *ServerPool) *Router {
+	rt := &Router{}
+	if defaultPool != nil {
+		rt.defaultRoute = &Route{Name: "default", Prefix: "/", Pool: defaultPool}
+	}
+	return rt
+}
+
+// AddRoute creates a new route and adds it to the routing table
+func (rt *Router) AddRoute(name string, pattern string, pool *ServerPool) (*Route, error) {
+	route, err := NewRoute(name, pattern, pool)
+	if err != nil {
+		return nil, err
+	}
+	rt.Add(route)
+	return route, nil
+}
+
+// Add adds the route to the routing table
+func (rt *Router) Add(route *Route) {
+	rt.routes = append(rt.routes, route)
+	// The routes are kept in the evaluation order, so the first match wins
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if sa, sb := a.specificity(), b.specificity(); sa != sb {
+			return sa > sb
+		}
+		// A regexp route narrows the paths down further than a prefix route of the same length
+		return a.Regexp != nil && b.Regexp == nil
+	})
+}
+
+// Match returns the route for the request. It returns nil if no route matches and there is no default pool
+func (rt *Router) Match(r *http.Request) *Route {
+	for _, route := range rt.routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return rt.defaultRoute
+}
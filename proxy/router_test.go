@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRouter_LongestPrefixWins(t *testing.T) {
+	defaultPool := NewServerPool(nil, nil)
+	apiPool := NewServerPool(nil, nil)
+	usersPool := NewServerPool(nil, nil)
+	chatPool := NewServerPool(nil, nil)
+
+	router := NewRouter(defaultPool)
+	mustAddRoute(t, router, "api", "/api/", apiPool)
+	mustAddRoute(t, router, "users", "/api/users/", usersPool)
+	mustAddRoute(t, router, "chat", "~^/ws/chat(/|$)", chatPool)
+
+	tests := map[string]*ServerPool{
+		"/api/orders":   apiPool,
+		"/api/users/42": usersPool,
+		"/ws/chat":      chatPool,
+		"/ws/chatty":    defaultPool,
+		"/index.html":   defaultPool,
+	}
+	for path, expected := range tests {
+		if route := router.Match(httptest.NewRequest("GET", path, nil)); route.Pool != expected {
+			t.Errorf("Path %s was routed to %s", path, route.Name)
+		}
+	}
+}
+
+func TestRouter_RegexpRoutesBySpecificity(t *testing.T) {
+	webPool := NewServerPool(nil, nil)
+	apiPool := NewServerPool(nil, nil)
+	versionedPool := NewServerPool(nil, nil)
+	phpPool := NewServerPool(nil, nil)
+
+	router := NewRouter(nil)
+	mustAddRoute(t, router, "web", "/", webPool)
+	mustAddRoute(t, router, "api", "/api/", apiPool)
+	mustAddRoute(t, router, "versioned", `~^/api/v\d+/`, versionedPool)
+	mustAddRoute(t, router, "php", `~\.php$`, phpPool)
+
+	tests := map[string]*ServerPool{
+		"/index.html":     webPool,
+		"/index.php":      phpPool,
+		"/api/orders":     apiPool,
+		"/api/v2/orders":  versionedPool,
+		"/api/legacy.php": apiPool,
+	}
+	for path, expected := range tests {
+		if route := router.Match(httptest.NewRequest("GET", path, nil)); route.Pool != expected {
+			t.Errorf("Path %s was routed to %s", path, route.Name)
+		}
+	}
+}
+
+func TestRouter_NoDefaultPool(t *testing.T) {
+	router := NewRouter(nil)
+	mustAddRoute(t, router, "api", "/api/", NewServerPool(nil, nil))
+
+	rec := httptest.NewRecorder()
+	RoutingHandler(NewVirtualHosts(router), false, Options{}).ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestRouter_InvalidPatterns(t *testing.T) {
+	router := NewRouter(nil)
+	if _, err := router.AddRoute("bad", "api", nil); err == nil {
+		t.Errorf("Expected an error for a prefix without a leading slash")
+	}
+	if _, err := router.AddRoute("bad", "~(", nil); err == nil {
+		t.Errorf("Expected an error for an invalid regexp")
+	}
+}
+
+func TestRoutingHandler_ProxiesToRoutePool(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+	apiUrl, _ := url.Parse(api.URL)
+
+	router := NewRouter(NewServerPool(nil, nil))
+	mustAddRoute(t, router, "api", "/api/", NewServerPool(testBackends([]*url.URL{apiUrl}), nil))
+
+	rec := httptest.NewRecorder()
+	RoutingHandler(NewVirtualHosts(router), false, Options{}).ServeHTTP(rec, httptest.NewRequest("GET", "/api/orders", nil))
+	if rec.Body.String() != "api" {
+		t.Errorf("Expected the response from the api pool, got %q", rec.Body.String())
+	}
+}
+
+func mustAddRoute(t *testing.T, router *Router, name string, pattern string, pool *ServerPool) *Route {
+	t.Helper()
+	route, err := router.AddRoute(name, pattern, pool)
+	if err != nil {
+		t.Fatalf("Failed to add route %s: %v", name, err)
+	}
+	return route
+}
@@ -1,34 +1,117 @@
 package proxy
 
 import (
-	"net/url"
-	"sync/atomic"
+	"crypto/tls"
+	"net/http"
+	"slices"
 )
 
 // ServerPool holds information about backend servers
 type ServerPool struct {
-	httpServers  []*url.URL
-	httpsServers []*url.URL
-	currentHttp  uint64
-	currentHttps uint64
+	httpServers  []*Backend
+	httpsServers []*Backend
+	balancer     Balancer
+	// tlsConfig configures the connections to the HTTPS backends. The proxy options are used if nil
+	tlsConfig *tls.Config
 }
 
-// NextHttpServer returns the next http server to use in round-robin fashion
-func (p *ServerPool) NextHttpServer() *url.URL {
-	server := p.httpServers[atomic.AddUint64(&p.currentHttp, 1)%uint64(len(p.httpServers))]
-	return server
+// NextServer returns the backend to proxy the request to, chosen by the pool balancer among the available ones.
+// It returns nil if there are no available servers left. The caller must call end on the returned backend
+// once the request is completed
+func (p *ServerPool) NextServer(r *http.Request, https bool) *Backend {
+	return p.NextServerExcept(r, https, nil)
 }
 
-// NextHttpsServer returns the next https server to use in round-robin fashion
-func (p *ServerPool) NextHttpsServer() *url.URL {
-	server := p.httpsServers[atomic.AddUint64(&p.currentHttps, 1)%uint64(len(p.httpsServers))]
-	return server
+// NextServerExcept is like NextServer but skips the given backends, e.g. the ones the request has already been tried on
+func (p *ServerPool) NextServerExcept(r *http.Request, https bool, except []*Backend) *Backend {
+	best := p.balancer.Pick(p.available(https, except), r)
+	if best != nil {
+		best.begin()
+	}
+	return best
 }
 
-// NewServerPool creates a new ServerPool
-func NewServerPool(httpUrls []*url.URL, httpsUrls []*url.URL) *ServerPool {
+// HasAvailable reports whether any backend other than the given ones is available
+func (p *ServerPool) HasAvailable(https bool, except []*Backend) bool {
+	return len(p.available(https, except)) > 0
+}
+
+// Acquire returns the backend with the given URL if it's available, bypassing the balancer.
+// The caller must call end on the returned backend once the request is completed
+func (p *ServerPool) Acquire(server string, https bool) *Backend {
+	for _, b := range p.servers(https) {
+		if b.URL.String() == server && b.Available() {
+			b.begin()
+			return b
+		}
+	}
+	return nil
+}
+
+// NextHttpServer returns the next available http server regardless of the request
+func (p *ServerPool) NextHttpServer() *Backend {
+	return p.NextServer(nil, false)
+}
+
+// NextHttpsServer returns the next available https server regardless of the request
+func (p *ServerPool) NextHttpsServer() *Backend {
+	return p.NextServer(nil, true)
+}
+
+// Backends returns all http and https backends of the pool
+func (p *ServerPool) Backends() []*Backend {
+	backends := make([]*Backend, 0, len(p.httpServers)+len(p.httpsServers))
+	backends = append(backends, p.httpServers...)
+	return append(backends, p.httpsServers...)
+}
+
+// SetBalancer replaces the load balancing strategy of the pool.
+// It must be called before the pool starts serving traffic
+func (p *ServerPool) SetBalancer(balancer Balancer) {
+	if b, ok := balancer.(poolBalancer); ok {
+		b.init(p.Backends())
+	}
+	p.balancer = balancer
+}
+
+// SetTLSConfig sets the configuration of the TLS connections to the backends of the pool, see NewBackendTLSConfig.
+// It must be called before the pool starts serving traffic
+func (p *ServerPool) SetTLSConfig(tlsConfig *tls.Config) {
+	p.tlsConfig = tlsConfig
+}
+
+// EnableOutlierDetection ejects backends from the pool based on the outcome of the proxied requests.
+// It must be called before the pool starts serving traffic
+func (p *ServerPool) EnableOutlierDetection(cfg OutlierDetectionConfig) {
+	for _, b := range p.Backends() {
+		b.breaker = newCircuitBreaker(b.URL.String(), cfg)
+	}
+}
+
+func (p *ServerPool) servers(https bool) []*Backend {
+	if https {
+		return p.httpsServers
+	}
+	return p.httpServers
+}
+
+// available returns the available backends other than the given ones
+func (p *ServerPool) available(https bool, except []*Backend) []*Backend {
+	backends := p.servers(https)
+	available := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.Available() && !slices.Contains(except, b) {
+			available = append(available, b)
+		}
+	}
+	return available
+}
+
+// NewServerPool creates a new ServerPool with the round-robin balancer
+func NewServerPool(httpBackends []*Backend, httpsBackends []*Backend) *ServerPool {
 	pool := &ServerPool{}
-	pool.httpServers = httpUrls
-	pool.httpsServers = httpsUrls
+	pool.httpServers = httpBackends
+	pool.httpsServers = httpsBackends
+	pool.balancer = &RoundRobin{}
 	return pool
 }
@@ -11,7 +11,7 @@ func TestServerPool_NextHttpServer(t *testing.T) {
 		{Host: "http://server2.com"},
 		{Host: "http://server3.com"},
 	}
-	pool := NewServerPool(httpUrls, nil)
+	pool := NewServerPool(testBackends(httpUrls), nil)
 
 	expectedServers := map[string]struct{}{
 		"http://server1.com": {},
@@ -22,11 +22,11 @@ func TestServerPool_NextHttpServer(t *testing.T) {
 	for i := 0; i < l; i++ {
 		server := pool.NextHttpServer()
 
-		if _, ok := expectedServers[server.Host]; !ok {
-			t.Errorf("Serve %s is not expected", server.Host)
+		if _, ok := expectedServers[server.URL.Host]; !ok {
+			t.Errorf("Serve %s is not expected", server.URL.Host)
 		}
 
-		delete(expectedServers, server.Host)
+		delete(expectedServers, server.URL.Host)
 	}
 
 	if len(expectedServers) != 0 {
@@ -40,7 +40,7 @@ func TestServerPool_NextHttpsServer(t *testing.T) {
 		{Host: "https://server2.com"},
 		{Host: "https://server3.com"},
 	}
-	pool := NewServerPool(httpsUrls, nil)
+	pool := NewServerPool(testBackends(httpsUrls), nil)
 
 	expectedServers := map[string]struct{}{
 		"https://server1.com": {},
@@ -52,13 +52,48 @@ func TestServerPool_NextHttpsServer(t *testing.T) {
 	for i := 0; i < l; i++ {
 		server := pool.NextHttpServer()
 
-		if _, ok := expectedServers[server.Host]; !ok {
-			t.Errorf("Serve %s is not expected", server.Host)
+		if _, ok := expectedServers[server.URL.Host]; !ok {
+			t.Errorf("Serve %s is not expected", server.URL.Host)
 		}
-		delete(expectedServers, server.Host)
+		delete(expectedServers, server.URL.Host)
 	}
 
 	if len(expectedServers) != 0 {
 		t.Errorf("Not all servers were used")
 	}
 }
+
+func TestServerPool_WeightedRoundRobin(t *testing.T) {
+	pool := NewServerPool([]*Backend{
+		NewBackend(&url.URL{Host: "big.com"}, 3),
+		NewBackend(&url.URL{Host: "small1.com"}, 1),
+		NewBackend(&url.URL{Host: "small2.com"}, 1),
+	}, nil)
+
+	counts := map[string]int{}
+	var picks []string
+	for i := 0; i < 50; i++ {
+		host := pool.NextHttpServer().URL.Host
+		counts[host]++
+		picks = append(picks, host)
+	}
+
+	if counts["big.com"] != 30 || counts["small1.com"] != 10 || counts["small2.com"] != 10 {
+		t.Errorf("Traffic is not split according to the weights: %v", counts)
+	}
+
+	// Smooth weighted round-robin never picks the big backend 3 times in a row
+	for i := 2; i < len(picks); i++ {
+		if picks[i] == "big.com" && picks[i-1] == "big.com" && picks[i-2] == "big.com" {
+			t.Fatalf("Burst of picks of the same backend: %v", picks)
+		}
+	}
+}
+
+func testBackends(urls []*url.URL) []*Backend {
+	backends := make([]*Backend, 0, len(urls))
+	for _, u := range urls {
+		backends = append(backends, NewBackend(u, 1))
+	}
+	return backends
+}
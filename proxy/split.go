@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+)
+
+// splitBuckets is the resolution of the traffic split. Clients are hashed into one of the buckets
+const splitBuckets = 10000
+
+// SplitTarget is a pool receiving a share of the traffic of the route
+type SplitTarget struct {
+	Name string
+	Pool *ServerPool
+}
+
+// TrafficSplit splits the traffic of a route between several pools by percentage, e.g. 95% stable and 5% canary.
+// The weights can be changed at runtime
+type TrafficSplit struct {
+	targets []SplitTarget
+	weights atomic.Pointer[[]int]
+	// StickyKey pins clients consistently to one of the pools by the hash of the key. Requests are split randomly if nil
+	StickyKey *HashKey
+	// OverrideHeader forces the pool named by the header value, e.g. "X-Canary: canary". Disabled if empty
+	OverrideHeader string
+}
+
+// NewTrafficSplit creates a new TrafficSplit with the weights given in the same order as the targets
+func NewTrafficSplit(targets []SplitTarget, weights []int) (*TrafficSplit, error) {
+	if len(targets) < 2 {
+		return nil, fmt.Errorf("traffic split requires at least two pools")
+	}
+	s := &TrafficSplit{targets: targets}
+	if err := s.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetWeights atomically replaces the weights of the targets. Weights are relative, so they don't have to add up to 100
+func (s *TrafficSplit) SetWeights(weights []int) error {
+	if len(weights) != len(s.targets) {
+		return fmt.Errorf("expected %d weights, got %d", len(s.targets), len(weights))
+	}
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("weight %d must not be negative", w)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	weights = append([]int(nil), weights...)
+	s.weights.Store(&weights)
+	return nil
+}
+
+// Weights returns the current weights of the targets by their names
+func (s *TrafficSplit) Weights() map[string]int {
+	weights := *s.weights.Load()
+	result := make(map[string]int, len(s.targets))
+	for i, t := range s.targets {
+		result[t.Name] = weights[i]
+	}
+	return result
+}
+
+// SetWeightsByName replaces the weights of the targets given by their names. Targets not mentioned get weight 0
+func (s *TrafficSplit) SetWeightsByName(byName map[string]int) error {
+	weights := make([]int, len(s.targets))
+	for name, w := range byName {
+		i := s.index(name)
+		if i < 0 {
+			return fmt.Errorf("unknown pool %q", name)
+		}
+		weights[i] = w
+	}
+	return s.SetWeights(weights)
+}
+
+// Pick returns the pool for the request
+func (s *TrafficSplit) Pick(r *http.Request) *ServerPool {
+	if s.OverrideHeader != "" {
+		if i := s.index(r.Header.Get(s.OverrideHeader)); i >= 0 {
+			return s.targets[i].Pool
+		}
+	}
+
+	var bucket int
+	if s.StickyKey != nil {
+		bucket = int(hashString(s.StickyKey.value(r)) % splitBuckets)
+	} else {
+		bucket = rand.IntN(splitBuckets)
+	}
+
+	weights := *s.weights.Load()
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	// The bucket is scaled to the total weight and mapped onto the cumulative weights
+	point := bucket * total / splitBuckets
+	for i, w := range weights {
+		if point < w {
+			return s.targets[i].Pool
+		}
+		point -= w
+	}
+	return s.targets[len(s.targets)-1].Pool
+}
+
+func (s *TrafficSplit) index(name string) int {
+	if name == "" {
+		return -1
+	}
+	for i, t := range s.targets {
+		if t.Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestSplit(t *testing.T, weights ...int) (*TrafficSplit, *ServerPool, *ServerPool) {
+	stable := NewServerPool(nil, nil)
+	canary := NewServerPool(nil, nil)
+	split, err := NewTrafficSplit([]SplitTarget{{"stable", stable}, {"canary", canary}}, weights)
+	if err != nil {
+		t.Fatalf("Failed to create traffic split: %v", err)
+	}
+	return split, stable, canary
+}
+
+func TestTrafficSplit_Percentages(t *testing.T) {
+	split, _, canary := newTestSplit(t, 90, 10)
+
+	canaryRequests := 0
+	for i := 0; i < 10000; i++ {
+		if split.Pick(httptest.NewRequest("GET", "/", nil)) == canary {
+			canaryRequests++
+		}
+	}
+	if canaryRequests < 800 || canaryRequests > 1200 {
+		t.Errorf("Expected about 10%% of requests to go to canary, got %d of 10000", canaryRequests)
+	}
+
+	if err := split.SetWeights([]int{0, 100}); err != nil {
+		t.Fatalf("Failed to change weights: %v", err)
+	}
+	if split.Pick(httptest.NewRequest("GET", "/", nil)) != canary {
+		t.Errorf("Expected all requests to go to canary")
+	}
+}
+
+func TestTrafficSplit_StickyAndOverride(t *testing.T) {
+	split, stable, canary := newTestSplit(t, 50, 50)
+	split.StickyKey = &HashKey{Source: "header", Name: "X-User"}
+	split.OverrideHeader = "X-Canary"
+
+	pools := map[*ServerPool]int{}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user%d", i))
+		pool := split.Pick(req)
+		for j := 0; j < 3; j++ {
+			if split.Pick(req) != pool {
+				t.Fatalf("user%d is not pinned to the same pool", i)
+			}
+		}
+		pools[pool]++
+	}
+	if pools[stable] == 0 || pools[canary] == 0 {
+		t.Errorf("Users should be spread across both pools, got %v", pools)
+	}
+
+	split.SetWeights([]int{100, 0})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Canary", "canary")
+	if split.Pick(req) != canary {
+		t.Errorf("Override header should force the canary pool")
+	}
+}
+
+func TestTrafficSplit_InvalidWeights(t *testing.T) {
+	split, _, _ := newTestSplit(t, 95, 5)
+	for _, weights := range [][]int{{100}, {0, 0}, {-1, 101}} {
+		if err := split.SetWeights(weights); err == nil {
+			t.Errorf("Expected an error for weights %v", weights)
+		}
+	}
+}
+
+func TestAdminHandler_ChangesSplitWeights(t *testing.T) {
+	split, _, _ := newTestSplit(t, 95, 5)
+	handler := AdminHandler(map[string]*TrafficSplit{"web": split}, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/splits/web", strings.NewReader(`{"stable": 80, "canary": 20}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if weights := split.Weights(); weights["stable"] != 80 || weights["canary"] != 20 {
+		t.Errorf("Weights were not changed: %v", weights)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/splits/web", strings.NewReader(`{"beta": 20}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown pool, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/splits", nil))
+	if !strings.Contains(rec.Body.String(), `"canary":20`) {
+		t.Errorf("Expected current weights, got %s", rec.Body.String())
+	}
+}
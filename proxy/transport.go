@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// TransportConfig configures the connections to the backends. Every backend has its own connection pool
+type TransportConfig struct {
+	// MaxIdleConns is the number of idle keep-alive connections kept open to every backend
+	MaxIdleConns int
+	// MaxConnsPerHost limits the connections to every backend, including the active ones. Unlimited if 0
+	MaxConnsPerHost int
+	// IdleTimeout is the time an idle connection is kept open
+	IdleTimeout time.Duration
+	// DialTimeout limits the time to open a TCP connection
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits the time of the TLS handshake with the HTTPS backends
+	TLSHandshakeTimeout time.Duration
+}
+
+// DefaultTransportConfig returns the configuration used by the handlers without transports
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:        100,
+		IdleTimeout:         90 * time.Second,
+		DialTimeout:         30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// defaultTransports serves the handlers created without transports
+var defaultTransports = NewTransports(DefaultTransportConfig())
+
+// Transports keeps a long-lived transport and reverse proxy per backend, so the connections to the backends are reused
+// across requests. The per-request behaviour of the reverse proxy is given by the attempt in the request context
+type Transports struct {
+	cfg     TransportConfig
+	mu      sync.Mutex
+	proxies map[*Backend]*backendProxy
+}
+
+// backendProxy is the reverse proxy of a backend along with its transport
+type backendProxy struct {
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+}
+
+// NewTransports creates a new, empty set of transports. Transports are created on the first request to every backend
+func NewTransports(cfg TransportConfig) *Transports {
+	return &Transports{cfg: cfg, proxies: make(map[*Backend]*backendProxy)}
+}
+
+// CloseIdleConnections closes the idle connections to all the backends, e.g. once the pools are replaced.
+// The connections in use are closed by the idle timeout once their request completes
+func (t *Transports) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.proxies {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// backendProxy returns the reverse proxy of the backend, creating it with the TLS configuration of the pool if needed
+func (t *Transports) backendProxy(pool *ServerPool, backend *Backend, opts Options) *backendProxy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.proxies[backend]; ok {
+		return p
+	}
+
+	dialer := &net.Dialer{Timeout: t.cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       opts.backendTLSConfig(pool),
+		MaxIdleConns:          t.cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.cfg.MaxIdleConns,
+		MaxConnsPerHost:       t.cfg.MaxConnsPerHost,
+		IdleConnTimeout:       t.cfg.IdleTimeout,
+		TLSHandshakeTimeout:   t.cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	p := &backendProxy{
+		transport: transport,
+		proxy: &httputil.ReverseProxy{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				// Hedged requests are sent to several backends, each with its own transport
+				if a := attemptFrom(req.Context()); a.hedge != nil {
+					return a.hedge.RoundTrip(req)
+				}
+				return transport.RoundTrip(req)
+			}),
+			Rewrite: func(r *httputil.ProxyRequest) {
+				rewriteToBackend(r, backend)
+				r.SetXForwarded()
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				return attemptFrom(resp.Request.Context()).modifyResponse(resp)
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				attemptFrom(req.Context()).errorHandler(w, req, err)
+			},
+			BufferPool: bufferPool{},
+		},
+	}
+	t.proxies[backend] = p
+	return p
+}
+
+// rewriteToBackend directs the outgoing request to the backend. The path of the request is appended to the backend path
+// and the host of the incoming request is kept
+func rewriteToBackend(r *httputil.ProxyRequest, backend *Backend) {
+	r.SetURL(backend.URL)
+	r.Out.Host = r.In.Host
+}
+
+// transport returns the transport of the backend
+func (t *Transports) transport(pool *ServerPool, backend *Backend, opts Options) http.RoundTripper {
+	return t.backendProxy(pool, backend, opts).transport
+}
+
+// attempt is the state of a single attempt to proxy a request to a backend
+type attempt struct {
+	// hedge sends the request to other backends as well if it's slow. Disabled if nil
+	hedge          *hedgedTransport
+	modifyResponse func(*http.Response) error
+	errorHandler   func(http.ResponseWriter, *http.Request, error)
+}
+
+type attemptKey struct{}
+
+func withAttempt(ctx context.Context, a *attempt) context.Context {
+	return context.WithValue(ctx, attemptKey{}, a)
+}
+
+func attemptFrom(ctx context.Context) *attempt {
+	return ctx.Value(attemptKey{}).(*attempt)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// bufferPool reuses the buffers the response bodies are copied with
+type bufferPool struct{}
+
+var buffers = sync.Pool{New: func() any { return make([]byte, 32*1024) }}
+
+func (bufferPool) Get() []byte  { return buffers.Get().([]byte) }
+func (bufferPool) Put(b []byte) { buffers.Put(b) }
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransports_ReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	pool := NewServerPool(nil, testBackends([]*url.URL{u}))
+	handler := ProxyHandler(pool, false, true, Options{SkipCertCheck: true, Transports: NewTransports(DefaultTransportConfig())})
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected the connection to the backend to be reused, got %d connections", n)
+	}
+}
+
+// BenchmarkProxyHTTP compares the pooled transports with a transport created for every request,
+// which opens a new connection with a TLS handshake every time
+func BenchmarkProxyHTTP(b *testing.B) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	run := func(b *testing.B, handler http.Handler) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				if rec.Code != http.StatusOK {
+					b.Errorf("Expected status 200, got %d", rec.Code)
+				}
+			}
+		})
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := NewServerPool(nil, testBackends([]*url.URL{u}))
+		transports := NewTransports(DefaultTransportConfig())
+		defer transports.CloseIdleConnections()
+		run(b, ProxyHandler(pool, false, true, Options{SkipCertCheck: true, Transports: transports}))
+	})
+
+	b.Run("transport per request", func(b *testing.B) {
+		run(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+			defer transport.CloseIdleConnections()
+			proxy := &httputil.ReverseProxy{
+				Transport: transport,
+				Rewrite: func(r *httputil.ProxyRequest) {
+					r.SetURL(u)
+				},
+			}
+			proxy.ServeHTTP(w, r)
+		}))
+	})
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// VirtualHosts maps the request Host header to routing tables, so several domains can be served by one proxy.
+// Exact host names take precedence over wildcards like "*.example.com", and the longest wildcard wins
+type VirtualHosts struct {
+	exact     map[string]*Router
+	wildcards []wildcardHost
+	// defaultRouter serves the requests to unknown hosts. Unknown hosts are rejected if nil
+	defaultRouter *Router
+	// UnknownHostStatus is the response status for unknown hosts, 421 Misdirected Request by default
+	UnknownHostStatus int
+}
+
+type wildcardHost struct {
+	// suffix is the wildcard without the leading "*", e.g. ".example.com"
+	suffix string
+	router *Router
+}
+
+// NewVirtualHosts creates new VirtualHosts. The default router might be nil, in which case requests
+// to unknown hosts are rejected
+func NewVirtualHosts(defaultRouter *Router) *VirtualHosts {
+	return &VirtualHosts{
+		exact:             make(map[string]*Router),
+		defaultRouter:     defaultRouter,
+		UnknownHostStatus: http.StatusMisdirectedRequest,
+	}
+}
+
+// AddHost maps the host name or the wildcard like "*.example.com" to the routing table
+func (vh *VirtualHosts) AddHost(host string, router *Router) error {
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		if !strings.HasPrefix(suffix, ".") || strings.Contains(suffix, "*") {
+			return fmt.Errorf("invalid wildcard host %q", host)
+		}
+		vh.wildcards = append(vh.wildcards, wildcardHost{suffix, router})
+		// Longer wildcards are checked first, so the first match is the most specific one
+		sort.SliceStable(vh.wildcards, func(i, j int) bool {
+			return len(vh.wildcards[i].suffix) > len(vh.wildcards[j].suffix)
+		})
+		return nil
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	vh.exact[host] = router
+	return nil
+}
+
+// Router returns the routing table for the request host. It returns nil if the host is unknown
+// and there is no default router
+func (vh *VirtualHosts) Router(r *http.Request) *Router {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if router, ok := vh.exact[host]; ok {
+		return router
+	}
+	for _, w := range vh.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.router
+		}
+	}
+	return vh.defaultRouter
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVirtualHosts_Router(t *testing.T) {
+	defaultRouter := NewRouter(nil)
+	exampleRouter := NewRouter(nil)
+	wildcardRouter := NewRouter(nil)
+	apiRouter := NewRouter(nil)
+
+	hosts := NewVirtualHosts(defaultRouter)
+	mustAddHost(t, hosts, "example.com", exampleRouter)
+	mustAddHost(t, hosts, "*.example.com", wildcardRouter)
+	mustAddHost(t, hosts, "*.api.example.com", apiRouter)
+
+	tests := map[string]*Router{
+		"example.com":        exampleRouter,
+		"EXAMPLE.com:8080":   exampleRouter,
+		"www.example.com":    wildcardRouter,
+		"v1.api.example.com": apiRouter,
+		"api.example.com":    wildcardRouter,
+		"other.com":          defaultRouter,
+		"notexample.com":     defaultRouter,
+		"[::1]:8080":         defaultRouter,
+	}
+	for host, expected := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if router := hosts.Router(req); router != expected {
+			t.Errorf("Host %s was routed to the wrong router", host)
+		}
+	}
+}
+
+func TestVirtualHosts_UnknownHost(t *testing.T) {
+	hosts := NewVirtualHosts(nil)
+	mustAddHost(t, hosts, "example.com", NewRouter(nil))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "other.com"
+	rec := httptest.NewRecorder()
+	RoutingHandler(hosts, false, Options{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusMisdirectedRequest, rec.Code)
+	}
+
+	hosts.UnknownHostStatus = http.StatusNotFound
+	rec = httptest.NewRecorder()
+	RoutingHandler(hosts, false, Options{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestVirtualHosts_InvalidHosts(t *testing.T) {
+	hosts := NewVirtualHosts(nil)
+	for _, host := range []string{"", "*example.com", "a.*.example.com"} {
+		if err := hosts.AddHost(host, NewRouter(nil)); err == nil {
+			t.Errorf("Expected an error for host %q", host)
+		}
+	}
+}
+
+func mustAddHost(t *testing.T, hosts *VirtualHosts, host string, router *Router) {
+	t.Helper()
+	if err := hosts.AddHost(host, router); err != nil {
+		t.Fatalf("Failed to add host %s: %v", host, err)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoServer starts a WebSocket backend echoing every message back
+func newEchoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, msg)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebSocket_DialRetriesAnotherBackend(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newEchoServer(t)
+
+	downUrl, _ := url.Parse(down.URL)
+	upUrl, _ := url.Parse(up.URL)
+	pool := NewServerPool(testBackends([]*url.URL{downUrl, upUrl}), nil)
+	proxy := httptest.NewServer(ProxyHandler(pool, true, false, Options{
+		WebSocketDialAttempts: 2,
+		WebSocketDialTimeout:  time.Second,
+	}))
+	defer proxy.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/websocket"
+	for i := 0; i < 4; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect to the proxy: %v", err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+			t.Fatalf("Expected echo, got %q: %v", msg, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebSocket_SingleDialAttempt(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	downUrl, _ := url.Parse(down.URL)
+	pool := NewServerPool(testBackends([]*url.URL{downUrl}), nil)
+	proxy := httptest.NewServer(ProxyHandler(pool, true, false, Options{}))
+	defer proxy.Close()
+
+	wsUrl := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/websocket"
+	_, resp, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %v", http.StatusServiceUnavailable, resp)
+	}
+}
+
+func TestWebSocket_SecureBackend(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "https" {
+			t.Errorf("Expected X-Forwarded-Proto https, got %q", proto)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msgType, msg, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(msgType, msg)
+		}
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	pool := NewServerPool(nil, testBackends([]*url.URL{backendUrl}))
+	proxy := httptest.NewTLSServer(ProxyHandler(pool, true, true, Options{SkipCertCheck: true}))
+	defer proxy.Close()
+
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(proxy.URL, "https")+"/websocket", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("Expected echo, got %q: %v", msg, err)
+	}
+}
+
+func TestWebSocket_TrustedBackendWithQuery(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "room=1&user=a%20b" {
+			t.Errorf("Expected the query string to be kept, got %q", r.URL.RawQuery)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+
+	// The backend certificate is verified with the CA bundle of the options rather than skipped
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	backendUrl, _ := url.Parse(backend.URL)
+	pool := NewServerPool(nil, testBackends([]*url.URL{backendUrl}))
+	proxy := httptest.NewServer(ProxyHandler(pool, true, true, Options{TLSConfig: &tls.Config{RootCAs: roots}}))
+	defer proxy.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/websocket?room=1&user=a%20b", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	conn.Close()
+}
+
+func TestWebSocketURL(t *testing.T) {
+	tests := []struct {
+		backend  string
+		request  string
+		expected string
+	}{
+		{"http://localhost:8081", "/websocket", "ws://localhost:8081/websocket"},
+		{"https://localhost:8524", "/websocket?room=1", "wss://localhost:8524/websocket?room=1"},
+		{"http://localhost:8081/chat/", "/ws/a%2Fb?x=1", "ws://localhost:8081/chat/ws/a%2Fb?x=1"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.backend)
+		req := httptest.NewRequest(http.MethodGet, tt.request, nil)
+		if got := webSocketURL(NewBackend(u, 1), req); got != tt.expected {
+			t.Errorf("Expected %s for %s%s, got %s", tt.expected, tt.backend, tt.request, got)
+		}
+	}
+}
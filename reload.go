@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pr/config"
+	"pr/middleware"
+	"pr/proxy"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// proxyState is everything built from the configuration. It's replaced as a whole when the configuration is reloaded,
+// while the requests and WebSocket connections in flight complete with the state they started with
+type proxyState struct {
+	cfg   *config.Config
+	pools map[string]*proxy.ServerPool
+	// splits are the traffic splits by route name, whose weights can be changed through the admin server
+	splits map[string]*proxy.TrafficSplit
+	// handlers serve the listeners, in the order of the configuration
+	handlers     []http.Handler
+	adminHandler http.Handler
+	affinity     *proxy.Affinity
+	diffLog      *proxy.DiffLog
+	// transports keep the connections to the backends of the pools open
+	transports *proxy.Transports
+	// stopHealthChecks stops the health checks of the pools
+	stopHealthChecks context.CancelFunc
+}
+
+// newProxyState builds the pools, routes and handlers from the configuration. The previous state, if any,
+// provides what must survive a reload, e.g. the random sticky session secret
+func newProxyState(cfg *config.Config, previous *proxyState) (*proxyState, error) {
+	state := &proxyState{cfg: cfg}
+	if previous != nil && previous.cfg.StickySession == cfg.StickySession {
+		state.affinity = previous.affinity
+	} else {
+		state.affinity = buildAffinity(cfg)
+	}
+	if previous != nil && previous.cfg.Mirror.DiffFile == cfg.Mirror.DiffFile {
+		state.diffLog = previous.diffLog
+	} else if cfg.Mirror.DiffFile != "" {
+		diffLog, err := proxy.OpenDiffLog(cfg.Mirror.DiffFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening mirror diff file: %v", err)
+		}
+		state.diffLog = diffLog
+	}
+
+	// Health checkers are stopped once the state is replaced or the shutdown is initiated
+	ctx, stopHealthChecks := context.WithCancel(context.Background())
+	pools, err := buildPools(ctx, cfg, previous.backends())
+	if err != nil {
+		stopHealthChecks()
+		return nil, err
+	}
+	routes, splits, mirrors, err := buildRoutes(cfg, pools, state.diffLog)
+	if err != nil {
+		stopHealthChecks()
+		return nil, err
+	}
+	if previous != nil {
+		keepSplitWeights(cfg, splits, previous)
+	}
+
+	opts := buildOptions(cfg)
+	opts.Affinity = state.affinity
+	state.transports = opts.Transports
+	validTokens := make(map[string]struct{})
+	for _, token := range cfg.Auth.Tokens {
+		validTokens[token] = struct{}{}
+	}
+	for _, listener := range cfg.Listeners {
+		hosts, err := buildVirtualHosts(cfg, pools, routes, listener)
+		if err != nil {
+			stopHealthChecks()
+			return nil, err
+		}
+		// WebSocket upgrade requests are detected by the routing handler regardless of the path
+		handler := proxy.RoutingHandler(hosts, listener.TLS != nil, opts)
+		state.handlers = append(state.handlers, middleware.Authorize(handler, validTokens))
+	}
+	state.pools = pools
+	state.splits = splits
+	state.stopHealthChecks = stopHealthChecks
+	state.adminHandler = proxy.AdminHandler(splits, mirrors)
+	return state, nil
+}
+
+// backends returns the backends of all the pools by URL. It returns nil if the state is nil
+func (s *proxyState) backends() map[string]*proxy.Backend {
+	if s == nil {
+		return nil
+	}
+	backends := make(map[string]*proxy.Backend)
+	for _, pool := range s.pools {
+		for _, b := range pool.Backends() {
+			backends[b.URL.String()] = b
+		}
+	}
+	return backends
+}
+
+// keepSplitWeights carries the weights changed through the admin server over to the splits whose configuration is
+// unchanged. A split changed in the configuration starts again with the configured weights
+func keepSplitWeights(cfg *config.Config, splits map[string]*proxy.TrafficSplit, previous *proxyState) {
+	for _, route := range cfg.Routes {
+		split, old := splits[route.Name], previous.splits[route.Name]
+		if split == nil || old == nil {
+			continue
+		}
+		i := slices.IndexFunc(previous.cfg.Routes, func(r config.Route) bool { return r.Name == route.Name })
+		if reflect.DeepEqual(previous.cfg.Routes[i].Split, route.Split) {
+			// The pools are the same, so the weights are valid
+			split.SetWeightsByName(old.Weights())
+		}
+	}
+}
+
+// reloader serves the requests with the current state and replaces it when the configuration changes
+type reloader struct {
+	// path of the configuration file. The configuration can't be reloaded from the environment variables
+	path  string
+	state atomic.Pointer[proxyState]
+	// mu serializes the reloads
+	mu sync.Mutex
+}
+
+// newReloader loads the configuration and builds the initial state
+func newReloader(path string) (*reloader, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := newProxyState(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	rl := &reloader{path: path}
+	rl.state.Store(state)
+	return rl, nil
+}
+
+// config returns the current configuration
+func (rl *reloader) config() *config.Config {
+	return rl.state.Load().cfg
+}
+
+// handler returns the handler of the listener, which always uses the current state
+func (rl *reloader) handler(listener int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.state.Load().handlers[listener].ServeHTTP(w, r)
+	})
+}
+
+// adminHandler returns the handler of the admin server, which always uses the current state
+func (rl *reloader) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.state.Load().adminHandler.ServeHTTP(w, r)
+	})
+}
+
+// reload re-reads and validates the configuration file and swaps the state. An invalid configuration is rejected
+// and the current state is kept
+func (rl *reloader) reload() error {
+	if rl.path == "" {
+		return fmt.Errorf("the configuration can only be reloaded from a configuration file")
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := config.Load(rl.path)
+	if err != nil {
+		return err
+	}
+	previous := rl.state.Load()
+	if !reflect.DeepEqual(cfg.Listeners, previous.cfg.Listeners) || cfg.Timeouts != previous.cfg.Timeouts || cfg.Admin != previous.cfg.Admin {
+		// The running servers can't be changed, so the new routes are served by the current listeners
+		log.Printf("Changes to the listeners, timeouts and admin server require a restart")
+		if err := validateListeners(cfg, previous.cfg.Listeners); err != nil {
+			return err
+		}
+		cfg.Listeners, cfg.Timeouts, cfg.Admin = previous.cfg.Listeners, previous.cfg.Timeouts, previous.cfg.Admin
+	}
+	state, err := newProxyState(cfg, previous)
+	if err != nil {
+		return err
+	}
+
+	rl.state.Store(state)
+	previous.stopHealthChecks()
+	// The connections in use by the requests in flight are closed by the idle timeout once they complete
+	previous.transports.CloseIdleConnections()
+	if previous.diffLog != nil && previous.diffLog != state.diffLog {
+		previous.diffLog.Close()
+	}
+	return nil
+}
+
+// validateListeners checks that the routes of the running listeners still exist in the new configuration
+func validateListeners(cfg *config.Config, listeners []config.Listener) error {
+	var errs []error
+	for _, listener := range listeners {
+		for _, route := range listener.Routes {
+			if !slices.ContainsFunc(cfg.Routes, func(r config.Route) bool { return r.Name == route }) {
+				errs = append(errs, fmt.Errorf("listener %s: unknown route %q, the listeners can only be changed with a restart", listener.Name, route))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stop stops the health checks of the current state
+func (rl *reloader) stop() {
+	rl.state.Load().stopHealthChecks()
+}
+
+// logReload reloads the configuration and logs the outcome
+func (rl *reloader) logReload() {
+	if err := rl.reload(); err != nil {
+		log.Printf("Configuration not reloaded, keeping the current one:\n%v", err)
+		return
+	}
+	log.Printf("Configuration reloaded from %s", rl.path)
+}
+
+// watch reloads the configuration whenever the file changes. The directory is watched rather than the file,
+// since editors and deployment tools often replace the file instead of writing to it. When the file is a symlink
+// the directory of its target is watched as well, and swapping the symlink, e.g. a Kubernetes ConfigMap update,
+// counts as a change
+func (rl *reloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(rl.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	target := rl.watchTarget(watcher, "")
+
+	go func() {
+		defer watcher.Close()
+		// Writes often come in bursts, the configuration is reloaded once they settle
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				changed := (name == filepath.Clean(rl.path) || name == target) && !event.Has(fsnotify.Chmod)
+				if current := rl.watchTarget(watcher, target); current != target {
+					target, changed = current, true
+				}
+				if changed {
+					debounce = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching %s: %v", rl.path, err)
+			case <-debounce:
+				debounce = nil
+				if _, err := os.Stat(rl.path); err != nil {
+					// The file is being replaced, it will come back with another event
+					continue
+				}
+				rl.logReload()
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTarget resolves the symlinks of the configuration file and watches the directory of the file they point to
+// when it has changed since the previous target. It returns the previous target if the file can't be resolved,
+// e.g. while it's being replaced
+func (rl *reloader) watchTarget(watcher *fsnotify.Watcher, previous string) string {
+	target, err := filepath.EvalSymlinks(rl.path)
+	if err != nil {
+		return previous
+	}
+	target = filepath.Clean(target)
+	if target != previous && filepath.Dir(target) != filepath.Dir(rl.path) {
+		if err := watcher.Add(filepath.Dir(target)); err != nil {
+			log.Printf("Error watching %s: %v", target, err)
+		}
+	}
+	return target
+}
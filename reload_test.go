@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig returns a configuration with a single listener proxying to the backend
+func testConfig(backend string) string {
+	return fmt.Sprintf(`
+listeners:
+  - name: http
+    address: "127.0.0.1:0"
+auth:
+  tokens: [secret]
+pools:
+  default:
+    http_backends:
+      - url: %s
+health_check:
+  path: /health
+  interval: 1h
+outlier_detection:
+  consecutive_failures: 1
+  cooldown: 1h
+`, backend)
+}
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestReloader(t *testing.T, content string) *reloader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, content)
+	rl, err := newReloader(path)
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	t.Cleanup(rl.stop)
+	return rl
+}
+
+// get sends a request through the listener of the reloader and returns the response body
+func get(rl *reloader) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Auth-Token", "secret")
+	rec := httptest.NewRecorder()
+	rl.handler(0).ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func newNamedServer(t *testing.T, name string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReloader_RejectsInvalidConfig(t *testing.T) {
+	backend := newNamedServer(t, "backend")
+	rl := newTestReloader(t, testConfig(backend.URL))
+	cfg := rl.config()
+
+	writeConfig(t, rl.path, testConfig(backend.URL)+"routes:\n  - name: api\n    path: /api/\n    pool: apii\n")
+	if err := rl.reload(); err == nil {
+		t.Fatalf("Expected an error for an unknown pool")
+	}
+
+	if rl.config() != cfg {
+		t.Errorf("Expected the current configuration to be kept")
+	}
+	if body := get(rl); body != "backend" {
+		t.Errorf("Expected the requests to be served with the current configuration, got %q", body)
+	}
+}
+
+func TestReloader_SwapsStateWithRequestsInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("old"))
+	}))
+	defer old.Close()
+	updated := newNamedServer(t, "new")
+	rl := newTestReloader(t, testConfig(old.URL))
+
+	inFlight := make(chan string)
+	go func() { inFlight <- get(rl) }()
+	<-started
+
+	writeConfig(t, rl.path, testConfig(updated.URL))
+	if err := rl.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if body := get(rl); body != "new" {
+		t.Errorf("Expected the new requests to go to the new backend, got %q", body)
+	}
+
+	// The request in flight completes with the state it started with
+	close(release)
+	if body := <-inFlight; body != "old" {
+		t.Errorf("Expected the request in flight to complete on the old backend, got %q", body)
+	}
+}
+
+func TestReloader_KeepsBackendState(t *testing.T) {
+	down := newNamedServer(t, "down")
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	content := testConfig(down.URL) + "hedge:\n  delay: 1s\n"
+	content = strings.Replace(content, "      - url: "+down.URL, "      - url: "+down.URL+"\n      - url: "+failing.URL, 1)
+	rl := newTestReloader(t, content)
+
+	// The first backend fails its health checks and the second one is ejected by outlier detection
+	rl.state.Load().pools["default"].Backends()[0].SetAlive(false)
+	get(rl)
+
+	writeConfig(t, rl.path, strings.Replace(content, "delay: 1s", "delay: 2s", 1))
+	if err := rl.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	backends := rl.state.Load().pools["default"].Backends()
+	if backends[0].Alive() {
+		t.Errorf("Expected the down backend to stay down after the reload")
+	}
+	if !backends[1].Alive() || backends[1].Available() {
+		t.Errorf("Expected the ejected backend to stay ejected after the reload")
+	}
+
+	// A backend with another URL starts afresh
+	writeConfig(t, rl.path, testConfig(newNamedServer(t, "other").URL))
+	if err := rl.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if !rl.state.Load().pools["default"].Backends()[0].Available() {
+		t.Errorf("Expected a new backend to be available")
+	}
+}
+
+func TestReloader_WatchesSymlinkSwap(t *testing.T) {
+	first := newNamedServer(t, "first")
+	second := newNamedServer(t, "second")
+
+	// The layout of a Kubernetes ConfigMap volume: the file points into a data directory swapped atomically
+	dir := t.TempDir()
+	for name, backend := range map[string]string{"v1": first.URL, "v2": second.URL} {
+		os.Mkdir(filepath.Join(dir, name), 0o700)
+		writeConfig(t, filepath.Join(dir, name, "config.yaml"), testConfig(backend))
+	}
+	os.Symlink("v1", filepath.Join(dir, "..data"))
+	path := filepath.Join(dir, "config.yaml")
+	os.Symlink(filepath.Join("..data", "config.yaml"), path)
+
+	rl, err := newReloader(path)
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	defer rl.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rl.watch(ctx); err != nil {
+		t.Fatalf("Failed to watch the configuration: %v", err)
+	}
+
+	os.Symlink("v2", filepath.Join(dir, "..data_tmp"))
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for get(rl) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the configuration to be reloaded after the symlink swap")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReloader_KeepsSplitWeights(t *testing.T) {
+	stable := newNamedServer(t, "stable")
+	canary := newNamedServer(t, "canary")
+	content := strings.Replace(testConfig(stable.URL), "health_check:", "  canary:\n    http_backends:\n      - url: "+canary.URL+"\nhealth_check:", 1) + `
+routes:
+  - name: api
+    path: /
+    split:
+      - pool: default
+        weight: 100
+      - pool: canary
+        weight: 0
+`
+	rl := newTestReloader(t, content)
+	if err := rl.state.Load().splits["api"].SetWeightsByName(map[string]int{"default": 50, "canary": 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The weights changed at runtime survive a reload leaving the split as it is
+	writeConfig(t, rl.path, content+"hedge:\n  delay: 1s\n")
+	if err := rl.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if weights := rl.state.Load().splits["api"].Weights(); weights["default"] != 50 || weights["canary"] != 50 {
+		t.Errorf("Expected the runtime weights to be kept, got %v", weights)
+	}
+
+	// A split changed in the configuration takes the configured weights
+	writeConfig(t, rl.path, strings.Replace(content, "weight: 0", "weight: 10", 1))
+	if err := rl.reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if weights := rl.state.Load().splits["api"].Weights(); weights["default"] != 100 || weights["canary"] != 10 {
+		t.Errorf("Expected the configured weights, got %v", weights)
+	}
+}
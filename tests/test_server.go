@@ -39,6 +39,11 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatalf("WebSocket upgrade failed: %v", err)
 	}
 
+	p := port
+	if r.TLS != nil {
+		p = httpsPort
+	}
+
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
@@ -46,7 +51,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		log.Printf("Received message on port %v: %s", port, msg)
+		log.Printf("Received message on port %v: %s", p, msg)
 
 		waitFor := extractWaitForFromMessage(string(msg))
 
@@ -58,7 +63,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		err = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Received message on port %v: %s", port, msg)))
+		err = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Received message on port %v: %s", p, msg)))
 		if err != nil {
 			log.Printf("WebSocket write failed: %v", err)
 			break
@@ -114,6 +114,29 @@ func TestWebsocketsRoundRobin(t *testing.T) {
 	}
 }
 
+func TestSecureWebsocketsRoundRobin(t *testing.T) {
+
+	u := url.URL{Scheme: "wss", Host: "localhost:8443", Path: "/websocket"}
+	auth := "token1"
+	headers := http.Header{"X-Auth-Token": {auth}}
+
+	port1 := testWsSingleConn(u, headers, t)
+	port2 := testWsSingleConn(u, headers, t)
+	port3 := testWsSingleConn(u, headers, t)
+
+	// Check if the messages were received on different ports
+	if port1 == port2 || port2 == port3 || port1 == port3 {
+		t.Errorf("Round-robin failed. Ports: %s, %s, %s", port1, port2, port3)
+	}
+
+	// Check if the connections were proxied to the HTTPS ports of the backends over wss
+	for _, port := range []string{port1, port2, port3} {
+		if port != "8524" && port != "8525" && port != "8526" {
+			t.Errorf("Expected the connection to be proxied to an HTTPS backend, got port %s", port)
+		}
+	}
+}
+
 func TestGracefulShutdown(t *testing.T) {
 	u := url.URL{Scheme: "ws", Host: "localhost:8080", Path: "/websocket"}
 	auth := "token1"
@@ -134,7 +157,7 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 
 	// Send sigterm to the proxy server
-	err = exec.Command("sh", "-c", `lsof -ti:8080 | xargs ps -ef | awk '$8~"main" {print $2}' | xargs kill -15`).Run()
+	err = exec.Command("sh", "-c", `lsof -ti:8080 -sTCP:LISTEN | xargs kill -15`).Run()
 	if err != nil {
 		log.Printf("Failed to kill the process. It's OK becase of pending WS connections: %v", err)
 	}
@@ -154,7 +177,10 @@ func TestGracefulShutdown(t *testing.T) {
 }
 
 func testWsSingleConn(u url.URL, headers http.Header, t *testing.T) string {
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
+	dialer := &websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, _, err := dialer.Dial(u.String(), headers)
 	if err != nil {
 		t.Fatalf("Failed to connect to WebSocket server: %v", err)
 	}
@@ -213,7 +239,7 @@ func runBackendsAndProxy() {
 		log.Fatalf("Failed to kill the process: %v", err)
 	}
 
-	cmd2 := exec.Command("sh", "-c", "cd .. && go run main.go")
+	cmd2 := exec.Command("sh", "-c", "cd .. && go run .")
 	startCmdAndStreamOutput(cmd2)
 }
 